@@ -0,0 +1,230 @@
+package shellwrapper
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type (
+	// Answers holds the answers collected in a session, stored under the
+	// storeAs given to each question. The answers to AskSecret are kept
+	// apart and are never in Answers
+	Answers struct {
+		mu      sync.RWMutex
+		answers map[string]Answer
+		keys    []string
+	}
+
+	// Answer is an answer as it was typed by the user (Raw) and the value
+	// it was read as (Value), such as an int for AskForInt
+	Answer struct {
+		Raw   string
+		Value any
+	}
+
+	// FilePath is a path to a file entered by the user; a leading ~ is
+	// expanded to the user's home directory and the path is cleaned
+	FilePath string
+
+	// parser reads an answer as a value of the type it is registered for;
+	// the text of its error is displayed to the user
+	parser func(string) (any, error)
+)
+
+// dateFormats are the formats accepted for time.Time answers
+var dateFormats = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+func newAnswers() *Answers {
+	return &Answers{
+		answers: make(map[string]Answer),
+		keys:    make([]string, 0),
+	}
+}
+
+// Get returns the answer stored as key
+func (a *Answers) Get(key string) (answer Answer, found bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	answer, found = a.answers[key]
+	return
+}
+
+// Keys returns the keys of the answers in the order they were first given
+func (a *Answers) Keys() []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return append([]string(nil), a.keys...)
+}
+
+// Export returns the values of all the answers by their keys, for example
+// to be encoded as JSON
+func (a *Answers) Export() map[string]any {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	values := make(map[string]any, len(a.answers))
+	for key, answer := range a.answers {
+		values[key] = answer.Value
+	}
+	return values
+}
+
+// Set stores value as the answer key, for example so that a function
+// passed to ThenRun can leave its result for the events that follow;
+// the answer's Raw is the value printed by fmt.Sprint
+func (a *Answers) Set(key string, value any) {
+	a.set(key, fmt.Sprint(value), value)
+}
+
+func (a *Answers) set(key, raw string, value any) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.answers[key]; !ok {
+		a.keys = append(a.keys, key)
+	}
+	a.answers[key] = Answer{Raw: raw, Value: value}
+}
+
+func (a *Answers) delete(key string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.answers[key]; !ok {
+		return
+	}
+	delete(a.answers, key)
+	for i, k := range a.keys {
+		if k == key {
+			a.keys = append(a.keys[:i], a.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// Answers returns the answers collected in the session so far
+func (s *Shell) Answers() *Answers {
+	return s.answers
+}
+
+// Get returns the answer stored as key as a T. The answer is read again
+// with the parser registered for T if it was stored as another type, so
+// the answer to Ask("timeout?", "timeout") can be read as a time.Duration.
+// found is false if there is no answer or it cannot be read as a T
+func Get[T any](s *Shell, key string) (result T, found bool) {
+	answer, ok := s.answers.Get(key)
+	if !ok {
+		return
+	}
+	if result, found = answer.Value.(T); found {
+		return
+	}
+	parse, ok := s.parsers[typeOf[T]()]
+	if !ok {
+		return
+	}
+	value, err := parse(answer.Raw)
+	if err != nil {
+		return
+	}
+	result, found = value.(T)
+	return
+}
+
+// AskFor promps the user for a T, which is read using the parser
+// registered for T; if it cannot be read the parser's error is displayed
+// and the user is prompted again. Parsers are registered for string, int,
+// int64, float64, bool, time.Duration, time.Time, *url.URL and FilePath;
+// other types must be registered with RegisterParser before AskFor is used
+func AskFor[T any](s *Shell, question, storeAs string) *Shell {
+	t := typeOf[T]()
+	if _, ok := s.parsers[t]; !ok {
+		flow := s.getFlow()
+		flow.problems = append(flow.problems, fmt.Errorf("no parser is registered for %s, asked for as '%s'", t, storeAs))
+	}
+	return s.ask(question, storeAs, s.handleTypedAnswer(t))
+}
+
+// RegisterParser registers parse as the way answers are read as a T by
+// AskFor and Get; the text of the error it returns is displayed to the
+// user, so it should explain what is expected
+func RegisterParser[T any](s *Shell, parse func(string) (T, error)) *Shell {
+	s.parsers[typeOf[T]()] = func(answer string) (any, error) {
+		return parse(answer)
+	}
+	return s
+}
+
+func typeOf[T any]() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
+
+// defaultParsers returns the parsers for the types that can be asked
+// for without registering a parser
+func (s *Shell) defaultParsers() map[reflect.Type]parser {
+	return map[reflect.Type]parser{
+		typeOf[string](): func(answer string) (any, error) {
+			return answer, nil
+		},
+		typeOf[int](): func(answer string) (any, error) {
+			result, err := strconv.Atoi(answer)
+			if err != nil {
+				return nil, errors.New("Please enter an integer e.g. 34")
+			}
+			return result, nil
+		},
+		typeOf[int64](): func(answer string) (any, error) {
+			result, err := strconv.ParseInt(answer, 10, 64)
+			if err != nil {
+				return nil, errors.New("Please enter an integer e.g. 34")
+			}
+			return result, nil
+		},
+		typeOf[float64](): func(answer string) (any, error) {
+			result, err := strconv.ParseFloat(answer, 64)
+			if err != nil {
+				return nil, errors.New("Please enter a number e.g. 3.1415")
+			}
+			return result, nil
+		},
+		typeOf[bool](): func(answer string) (any, error) {
+			result, ok := s.parseBool(answer)
+			if !ok {
+				return nil, fmt.Errorf("Please enter %s or %s", s.truthy[0], s.falsy[0])
+			}
+			return result, nil
+		},
+		typeOf[time.Duration](): func(answer string) (any, error) {
+			result, err := time.ParseDuration(answer)
+			if err != nil {
+				return nil, errors.New("Please enter a duration e.g. 1h30m")
+			}
+			return result, nil
+		},
+		typeOf[time.Time](): func(answer string) (any, error) {
+			for _, format := range dateFormats {
+				if result, err := time.ParseInLocation(format, answer, time.Local); err == nil {
+					return result, nil
+				}
+			}
+			return nil, errors.New("Please enter a date e.g. 2006-01-02 or 2006-01-02 15:04")
+		},
+		typeOf[*url.URL](): func(answer string) (any, error) {
+			result, err := url.Parse(answer)
+			if err != nil || len(result.Scheme) < 1 || len(result.Host) < 1 {
+				return nil, errors.New("Please enter a URL e.g. https://example.com")
+			}
+			return result, nil
+		},
+		typeOf[FilePath](): func(answer string) (any, error) {
+			path, err := expandHome(answer)
+			if err != nil {
+				return nil, fmt.Errorf("Please enter a path without ~ (%s)", err.Error())
+			}
+			return FilePath(filepath.Clean(path)), nil
+		},
+	}
+}
@@ -0,0 +1,181 @@
+package shellwrapper
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// AskChoice prompts the user to choose one of the options, which are
+// listed in a numbered menu; options is called each time the question is
+// asked, so the list may be loaded at runtime. The user may enter either
+// the number or the option itself (regardless of case), and is prompted
+// again if it matches neither; an input that is exactly one of the options
+// chooses that option rather than the one numbered by it. The option
+// chosen is retrieved with GetValue
+func (s *Shell) AskChoice(question, storeAs string, options func() []string) *Shell {
+	s.ask(question, storeAs, s.handleChoiceAnswer)
+	s.lastQuestion.options = options
+	return s
+}
+
+// AskMultiChoice prompts the user to choose one or more of the options,
+// which are listed in a numbered menu as with AskChoice. The user enters
+// numbers, ranges such as 1-3 and options separated by commas, and is
+// prompted again if any of them match no option. The options chosen are
+// retrieved, in the order of the menu, with GetValues
+func (s *Shell) AskMultiChoice(question, storeAs string, options func() []string) *Shell {
+	s.ask(question, storeAs, s.handleMultiChoiceAnswer)
+	s.lastQuestion.options = options
+	s.lastQuestion.multiple = true
+	return s
+}
+
+func (s *Shell) handleChoiceAnswer(command string) bool {
+	if command == exitUUID {
+		return true
+	}
+	if len(command) < 1 {
+		return false
+	}
+	choice, ok := s.asking.choose(command)
+	if !ok {
+		s.waitForShellOutput("choice_conversion", fmt.Sprintf("%sPlease enter a number from 1 to %d, or one of the options", s.prompt, len(s.asking.choices)), false, false)
+		return false
+	}
+	s.answers.set(s.awaitingAnswer, choice, choice)
+	return true
+}
+
+func (s *Shell) handleMultiChoiceAnswer(command string) bool {
+	if command == exitUUID {
+		return true
+	}
+	if len(command) < 1 {
+		return false
+	}
+	choices, err := s.asking.chooseMany(command)
+	if err != nil {
+		s.waitForShellOutput("choice_conversion", fmt.Sprintf("%s%s; please enter numbers from 1 to %d, ranges such as 1-%d or options, separated by commas", s.prompt, err.Error(), len(s.asking.choices), len(s.asking.choices)), false, false)
+		return false
+	}
+	s.answers.set(s.awaitingAnswer, command, choices)
+	return true
+}
+
+// loadChoices loads the options of the question; the session ends if
+// there are none to choose from
+func (s *Shell) loadChoices(q *question) bool {
+	q.choices = q.options()
+	if len(q.choices) < 1 {
+		s.fail(ErrMisconfigured, fmt.Errorf("there are no options to choose from for '%s'", q.storeAs))
+		return false
+	}
+	return true
+}
+
+// menu lists the options of the question, numbered from 1
+func (s *Shell) menu(q *question) string {
+	indent := strings.Repeat(" ", len(s.prompt))
+	menu := make([]string, 0, len(q.choices))
+	for i, choice := range q.choices {
+		menu = append(menu, fmt.Sprintf("%s%d) %s", indent, i+1, choice))
+	}
+	return "\n" + strings.Join(menu, "\n")
+}
+
+// choose returns the option the user's input refers to, by its number
+// or its text
+func (q *question) choose(input string) (string, bool) {
+	i, ok := q.choiceIndex(input)
+	if !ok {
+		return "", false
+	}
+	return q.choices[i], true
+}
+
+// choiceIndex returns the index of the option the user's input refers to;
+// an option that is exactly the input is preferred to its number, so that
+// options that are numbers themselves can be chosen
+func (q *question) choiceIndex(input string) (int, bool) {
+	exact := -1
+	for i, choice := range q.choices {
+		if choice == input {
+			if exact >= 0 {
+				// the options are ambiguous, so the number decides
+				exact = -1
+				break
+			}
+			exact = i
+		}
+	}
+	if exact >= 0 {
+		return exact, true
+	}
+	if n, err := strconv.Atoi(input); err == nil && n >= 1 && n <= len(q.choices) {
+		return n - 1, true
+	}
+	for i, choice := range q.choices {
+		if choice == input {
+			return i, true
+		}
+	}
+	for i, choice := range q.choices {
+		if strings.EqualFold(choice, input) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// chooseMany returns the options the user's input refers to by their
+// numbers, ranges of numbers or text, separated by commas
+func (q *question) chooseMany(input string) ([]string, error) {
+	chosen := make([]bool, len(q.choices))
+	found := false
+	for _, part := range strings.Split(input, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) < 1 {
+			continue
+		}
+		first, last, err := q.choiceRange(part)
+		if err != nil {
+			return nil, err
+		}
+		for i := first; i <= last; i++ {
+			chosen[i] = true
+			found = true
+		}
+	}
+	if !found {
+		return nil, errors.New("no options were chosen")
+	}
+	choices := make([]string, 0, len(q.choices))
+	for i, choice := range q.choices {
+		if chosen[i] {
+			choices = append(choices, choice)
+		}
+	}
+	return choices, nil
+}
+
+// choiceRange returns the indexes of the first and last options that
+// part refers to, which is a number, a range such as 1-3 or an option
+func (q *question) choiceRange(part string) (int, int, error) {
+	if from, to, ok := strings.Cut(part, "-"); ok {
+		first, errFirst := strconv.Atoi(strings.TrimSpace(from))
+		last, errLast := strconv.Atoi(strings.TrimSpace(to))
+		if errFirst == nil && errLast == nil {
+			if first < 1 || last > len(q.choices) || first > last {
+				return 0, 0, fmt.Errorf("'%s' is not a range of options", part)
+			}
+			return first - 1, last - 1, nil
+		}
+	}
+	i, ok := q.choiceIndex(part)
+	if !ok {
+		return 0, 0, fmt.Errorf("'%s' is not one of the options", part)
+	}
+	return i, i, nil
+}
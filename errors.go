@@ -0,0 +1,109 @@
+package shellwrapper
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrUserQuit is the reason given when the user inputs quit or exit
+	ErrUserQuit = errors.New("user quit")
+	// ErrDeclined is the reason given when the user declines a Confirm
+	// with no previous prompt to go back to
+	ErrDeclined = errors.New("declined")
+	// ErrInterrupted is the reason given when the shell receives a signal
+	ErrInterrupted = errors.New("interrupted")
+	// ErrCanceled is the reason given when the context passed to Run is cancelled
+	ErrCanceled = errors.New("canceled")
+	// ErrInputClosed is the reason given when the user's input reaches EOF
+	ErrInputClosed = errors.New("input closed")
+	// ErrInputFailed is the reason given when the user's input cannot be read
+	ErrInputFailed = errors.New("input failed")
+	// ErrExecFailed is the reason given when a function passed to ThenRun
+	// returns an error wrapped with Fatal
+	ErrExecFailed = errors.New("function failed")
+	// ErrMisconfigured is the reason given when the flow refers to something
+	// that does not exist, such as a branch that has not been set up
+	ErrMisconfigured = errors.New("misconfigured flow")
+
+	// ErrTimeout is matched by the error of a function passed to ThenRun
+	// that runs past its timeout; the error is displayed apart from other
+	// errors, and OnError may tell the two apart with errors.Is
+	ErrTimeout = errors.New("timed out")
+
+	errEnded     = errors.New("session ended")
+	errInterrupt = errors.New("interrupt")
+	errAbandoned = errors.New("read abandoned")
+)
+
+type (
+	// ExitError is returned by Start when a session ends for any reason other
+	// than the flow coming to an end or ThenQuit. Reason is one of the Err
+	// variables of this package; Err is the underlying cause, if any
+	ExitError struct {
+		Reason error
+		Err    error
+	}
+
+	fatalError struct {
+		err error
+	}
+
+	// timeoutError is the error of a function that runs past its timeout;
+	// err is the error the function returned, if any
+	timeoutError struct {
+		message string
+		timeout time.Duration
+		err     error
+	}
+)
+
+func (e *ExitError) Error() string {
+	if e.Err == nil {
+		return e.Reason.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.Reason.Error(), e.Err.Error())
+}
+
+// Unwrap lets errors.Is and errors.As match both the reason and the cause
+func (e *ExitError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Reason}
+	}
+	return []error{e.Reason, e.Err}
+}
+
+// Fatal wraps err so that returning it from a function passed to ThenRun
+// ends the session; Start then returns an ExitError with the reason
+// ErrExecFailed
+func Fatal(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &fatalError{err: err}
+}
+
+func (f *fatalError) Error() string {
+	return f.err.Error()
+}
+
+func (f *fatalError) Unwrap() error {
+	return f.err
+}
+
+func (t *timeoutError) Error() string {
+	if t.err == nil {
+		return fmt.Sprintf("%s %s after %s", t.message, ErrTimeout.Error(), t.timeout)
+	}
+	return fmt.Sprintf("%s %s after %s (%s)", t.message, ErrTimeout.Error(), t.timeout, t.err.Error())
+}
+
+// Unwrap lets errors.Is match ErrTimeout and errors.As match the error
+// the function returned
+func (t *timeoutError) Unwrap() []error {
+	if t.err == nil {
+		return []error{ErrTimeout}
+	}
+	return []error{ErrTimeout, t.err}
+}
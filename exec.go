@@ -0,0 +1,120 @@
+package shellwrapper
+
+import (
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// ExitCodeKey is the key the exit code of the command run by ThenExec
+// is stored as, like $? in a shell; it is -1 if the command could not be
+// started or was killed
+const ExitCodeKey = "exit_code"
+
+// execStep holds the settings of a ThenExec event; timeout is in
+// milliseconds, and the flow's WaitTime is used if it is 0
+type execStep struct {
+	hideOutput bool
+	timeout    uint
+}
+
+// ThenExec runs the command name with args, which may refer to the answers
+// collected so far as {{.storeAs}}. The output of the command is displayed
+// as it is written, and the exit code is stored as ExitCodeKey; the
+// command fails if it exits with any other code than 0. If the command
+// runs past its timeout, which is the flow's WaitTime unless it is set
+// with Timeout, it is killed along with any processes it started. It may
+// be followed by HideOutput, Timeout, Retry, OnError and OnSuccess
+func (s *Shell) ThenExec(name string, args ...string) *Shell {
+	for _, arg := range args {
+		s.checkTemplate(arg)
+	}
+	settings := &execStep{}
+	step := s.addRun(func(timeout uint, attempt string) error {
+		rendered := make([]string, 0, len(args))
+		for _, arg := range args {
+			arg, ok := s.render(arg)
+			if !ok {
+				return errEnded
+			}
+			rendered = append(rendered, arg)
+		}
+		message := strings.Join(append([]string{name}, rendered...), " ")
+		if settings.timeout > 0 {
+			timeout = settings.timeout
+		}
+		return s.runFunc(int(timeout), message+attempt, func(j *jitter) error {
+			return s.exec(j, settings, name, rendered)
+		})
+	}, 0)
+	step.exec = settings
+	return s
+}
+
+// HideOutput hides the output of the command run by the preceding
+// ThenExec, unless the command fails
+func (s *Shell) HideOutput() *Shell {
+	step, ok := s.runStep("HideOutput")
+	if !ok {
+		return s
+	}
+	if step.exec == nil {
+		flow := s.getFlow()
+		flow.problems = append(flow.problems, errors.New("HideOutput must directly follow ThenExec"))
+		return s
+	}
+	step.exec.hideOutput = true
+	return s
+}
+
+// Timeout gives the command run by the preceding ThenExec timeout
+// milliseconds to run, in place of the flow's WaitTime
+func (s *Shell) Timeout(timeout uint) *Shell {
+	step, ok := s.runStep("Timeout")
+	if !ok {
+		return s
+	}
+	flow := s.getFlow()
+	if step.exec == nil {
+		flow.problems = append(flow.problems, errors.New("Timeout must directly follow ThenExec"))
+		return s
+	}
+	if timeout < 1 {
+		flow.problems = append(flow.problems, errors.New("the timeout of ThenExec must be at least 1ms"))
+		return s
+	}
+	step.exec.timeout = timeout
+	return s
+}
+
+// exec runs the command, displaying its output above the spinner
+func (s *Shell) exec(j *jitter, settings *execStep, name string, args []string) error {
+	hidden := make([]string, 0)
+	output := &lineWriter{line: s.print}
+	if settings.hideOutput {
+		// stdout and stderr share the writer, so it is not written to at once
+		output.line = func(line string) {
+			hidden = append(hidden, line)
+		}
+	}
+	cmd := exec.CommandContext(j.ctx, name, args...)
+	cmd.Stdout, cmd.Stderr = output, output
+	prepareCommand(cmd)
+	if s.gracePeriod > 0 {
+		cmd.WaitDelay = s.gracePeriod
+	}
+	err := cmd.Run()
+	output.flush()
+	code := -1
+	if cmd.ProcessState != nil {
+		code = cmd.ProcessState.ExitCode()
+	}
+	s.answers.set(ExitCodeKey, strconv.Itoa(code), code)
+	if err != nil {
+		for _, line := range hidden {
+			s.print(line)
+		}
+	}
+	return err
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package shellwrapper
+
+import "os/exec"
+
+// prepareCommand leaves the command to be killed on its own, as process
+// groups are not supported on this platform
+func prepareCommand(cmd *exec.Cmd) {}
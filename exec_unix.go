@@ -0,0 +1,18 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package shellwrapper
+
+import (
+	"os/exec"
+
+	"golang.org/x/sys/unix"
+)
+
+// prepareCommand starts the command in a process group of its own, so
+// that the processes it starts are killed along with it
+func prepareCommand(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &unix.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return unix.Kill(-cmd.Process.Pid, unix.SIGKILL)
+	}
+}
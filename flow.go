@@ -15,9 +15,28 @@ type (
 		Events         *list.List
 		Flows          Flows
 		BaseCommands   []string
+		links          []flowLink
+		problems       []error
+		prompt         *list.Element
 	}
 
-	ExecFunc  func(context.Context, context.CancelFunc) error
+	// flowLink records rules that are only built once the shell is
+	// running, so that they can be validated beforehand; step names the
+	// builder function and label the flow the rules are built into, if
+	// they are not built into the flow the link belongs to
+	flowLink struct {
+		branch string
+		build  FlowFunc
+		step   string
+		label  string
+	}
+
+	ExecFunc func(context.Context, context.CancelFunc) error
+	// SessionFunc is a function passed to ThenRunWithSession
+	SessionFunc func(*Session) error
+	// FlowFunc sets up rules with the shell's builder functions. It is run
+	// by Validate (and so by Start) as well as when the flow reaches it,
+	// so it should have no other side effects
 	FlowFunc  func()
 	Flows     map[string]*Flow
 	EventFunc func(*list.Element) *list.Element
@@ -1,13 +1,11 @@
 module github.com/blainemoser/shellwrapper
 
-go 1.20
+go 1.21
 
 require (
 	github.com/google/uuid v1.3.0
 	github.com/gosuri/uilive v0.0.4
+	golang.org/x/sys v0.6.0
 )
 
-require (
-	github.com/mattn/go-isatty v0.0.19 // indirect
-	golang.org/x/sys v0.6.0 // indirect
-)
+require github.com/mattn/go-isatty v0.0.19 // indirect
@@ -0,0 +1,106 @@
+package shellwrapper
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// historySize is the number of lines kept in the history
+const historySize = 500
+
+// history holds the lines entered by the user, oldest first, independently
+// of the Buffer; if file is set each line is also appended to it, so that
+// the history is kept between sessions
+type history struct {
+	lines []string
+	file  string
+}
+
+// newHistory returns a history loaded from file, which may start with
+// ~ for the user's home directory; an empty file keeps the history in memory
+func newHistory(file string) (*history, error) {
+	h := &history{lines: make([]string, 0)}
+	if len(file) < 1 {
+		return h, nil
+	}
+	path, err := expandHome(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not find the history file: %w", err)
+	}
+	h.file = path
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read the history file: %w", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	for _, line := range lines {
+		h.push(line)
+	}
+	// lines are appended as they are entered, so the file is trimmed here
+	if len(lines) > historySize {
+		if err := os.WriteFile(path, []byte(strings.Join(h.lines, "\n")+"\n"), 0600); err != nil {
+			return nil, fmt.Errorf("could not trim the history file: %w", err)
+		}
+	}
+	return h, nil
+}
+
+// add records a line entered by the user; empty lines and repeats of the
+// last line are skipped
+func (h *history) add(line string) error {
+	if !h.push(line) || len(h.file) < 1 {
+		return nil
+	}
+	f, err := os.OpenFile(h.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (h *history) push(line string) bool {
+	if len(line) < 1 || line == h.last() {
+		return false
+	}
+	if len(h.lines) >= historySize {
+		copy(h.lines, h.lines[1:])
+		h.lines = h.lines[:len(h.lines)-1]
+	}
+	h.lines = append(h.lines, line)
+	return true
+}
+
+// last returns the line most recently entered, or "" if there is none
+func (h *history) last() string {
+	if len(h.lines) < 1 {
+		return ""
+	}
+	return h.lines[len(h.lines)-1]
+}
+
+// snapshot returns a copy of the lines for the line editor
+func (h *history) snapshot() []string {
+	return append([]string(nil), h.lines...)
+}
+
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, strings.TrimPrefix(path, "~")), nil
+}
@@ -0,0 +1,289 @@
+package shellwrapper
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+type (
+	// readDeadliner is implemented by inputs whose pending reads can be
+	// interrupted, such as pipes created with os.Pipe and network connections
+	readDeadliner interface {
+		SetReadDeadline(t time.Time) error
+	}
+
+	// cancelReader reads from an input whose pending reads cannot be
+	// interrupted, such as io.Pipe. A read returns errEnded once done is
+	// closed, leaving the read of the input to finish in the background,
+	// and errAbandoned if a value is received from abandon, in which case
+	// what the pending read has already returned is discarded and what it
+	// returns from then on is kept for the next read
+	cancelReader struct {
+		in      io.Reader
+		done    <-chan struct{}
+		abandon <-chan struct{}
+		pending chan readResult
+		rest    []byte
+		err     error
+	}
+
+	// readResult is the outcome of a read made by a cancelReader
+	readResult struct {
+		data []byte
+		err  error
+	}
+
+	// inputRequest asks the input pump for a line; completions are the
+	// inputs offered by the line editor when the user presses tab, history
+	// the lines recalled with the up and down arrows, and hidden stops
+	// the line from being echoed
+	inputRequest struct {
+		completions []string
+		history     []string
+		hidden      bool
+	}
+)
+
+// pumpInput is the only goroutine that reads the user's input. It reads a
+// line each time one is requested with requestInput, sends it on UserInput
+// and returns once the session has ended
+func (s *Shell) pumpInput() {
+	defer close(s.pumpDone)
+	for {
+		var request inputRequest
+		select {
+		case request = <-s.inputRequests:
+		case <-s.cancel:
+			return
+		}
+		userInput, err := s.readInput(request)
+		if s.ended() {
+			return
+		}
+		if s.abandoned(err) {
+			s.abandonHandled()
+			continue
+		}
+		// a last line without a newline is still handled; the next read returns EOF
+		if err != nil && (!errors.Is(err, io.EOF) || len(userInput) < 1) {
+			s.inputFailed(err)
+			return
+		}
+		select {
+		case s.UserInput <- userInput:
+		case <-s.abandon:
+			// the line was typed for a prompt that is no longer waiting
+			s.clearDeadline()
+			s.abandonHandled()
+		case <-s.cancel:
+			return
+		}
+	}
+}
+
+// readInput reads a line using the line editor if the input and output
+// are TTYs; otherwise the input is read a line at a time, without echo
+// if the line is hidden and the input is a TTY
+func (s *Shell) readInput(request inputRequest) (string, error) {
+	if s.editor == nil {
+		if request.hidden && s.terminal != nil {
+			if err := s.terminal.hide(); err != nil {
+				return "", err
+			}
+			defer s.terminal.restore()
+		}
+		return s.Reader.ReadString('\n')
+	}
+	if err := s.terminal.edit(); err != nil {
+		return "", err
+	}
+	defer s.terminal.restore()
+	if request.hidden {
+		return s.editor.readHidden()
+	}
+	return s.editor.readLine(request.completions, request.history)
+}
+
+// requestInput asks the input pump for the next line
+func (s *Shell) requestInput(request inputRequest) {
+	select {
+	case s.inputRequests <- request:
+	case <-s.cancel:
+	}
+}
+
+// abandonInput interrupts the read of the line requested by a prompt that
+// stops waiting for it, so that the next prompt makes a read of its own;
+// a line that has already been read is discarded. It returns once the
+// input pump has let go of the line, so that what is typed afterwards is
+// kept for the next prompt
+func (s *Shell) abandonInput() {
+	select {
+	case s.abandon <- struct{}{}:
+	default:
+		// the read has been abandoned already
+	}
+	if s.terminal == nil {
+		if d, ok := s.input.(readDeadliner); ok {
+			d.SetReadDeadline(time.Now())
+		}
+	}
+	select {
+	case <-s.abandonDone:
+	case <-s.cancel:
+	}
+}
+
+// abandonHandled tells abandonInput that the pump has let go of the line
+func (s *Shell) abandonHandled() {
+	select {
+	case s.abandonDone <- struct{}{}:
+	case <-s.cancel:
+	}
+}
+
+// abandoned reports whether the read that returned err was interrupted by
+// abandonInput
+func (s *Shell) abandoned(err error) bool {
+	if errors.Is(err, errAbandoned) {
+		s.clearDeadline()
+		return true
+	}
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+	select {
+	case <-s.abandon:
+		s.clearDeadline()
+		return true
+	default:
+		return false
+	}
+}
+
+// clearDeadline clears the read deadline set by abandonInput
+func (s *Shell) clearDeadline() {
+	if d, ok := s.input.(readDeadliner); ok && s.terminal == nil {
+		d.SetReadDeadline(time.Time{})
+	}
+}
+
+// inputRequest returns the request for the current prompt
+func (s *Shell) inputRequest() inputRequest {
+	if s.asking != nil && s.asking.secret {
+		return inputRequest{hidden: true}
+	}
+	if s.asking != nil && len(s.asking.choices) > 0 && !s.asking.multiple {
+		// the arrows step through the options
+		return inputRequest{completions: s.asking.choices, history: s.asking.choices}
+	}
+	return inputRequest{completions: s.completions(), history: s.history.snapshot()}
+}
+
+// completions returns the inputs accepted at the current prompt
+func (s *Shell) completions() []string {
+	if len(s.awaitingAnswer) > 0 {
+		return nil
+	}
+	completions := []string{QUIT, EXIT}
+	if len(s.visited) > 0 {
+		completions = append(completions, BACK)
+	}
+	for command := range s.flow.Flows {
+		completions = append(completions, command)
+	}
+	return completions
+}
+
+// stopInput waits for the input pump to return once the session has ended.
+// A pending read is interrupted by a read deadline if the input allows it;
+// the reads of files and other inputs (see inputReader) return as soon as
+// the session ends
+func (s *Shell) stopInput() {
+	if s.terminal == nil {
+		if d, ok := s.input.(readDeadliner); ok && d.SetReadDeadline(time.Now()) == nil {
+			defer d.SetReadDeadline(time.Time{})
+		}
+	}
+	<-s.pumpDone
+}
+
+// inputFailed ends the session when the user's input can no longer be read
+func (s *Shell) inputFailed(err error) {
+	if errors.Is(err, errInterrupt) {
+		s.end(&ExitError{Reason: ErrInterrupted})
+		return
+	}
+	if errors.Is(err, io.EOF) {
+		s.end(&ExitError{Reason: ErrInputClosed})
+		return
+	}
+	s.bufferError(err)
+	s.end(&ExitError{Reason: ErrInputFailed, Err: err})
+}
+
+// inputReader returns the reader of the user's input. Reads of files,
+// such as a piped os.Stdin, are polled so that they return once done is
+// closed or a value is received from abandon; reads of other inputs are
+// interrupted with a read deadline if the input has one, or otherwise
+// abandoned
+func inputReader(in io.Reader, done, abandon <-chan struct{}) *bufio.Reader {
+	if r, ok := fileReader(in, done, abandon); ok {
+		return bufio.NewReader(r)
+	}
+	if d, ok := in.(readDeadliner); ok && d.SetReadDeadline(time.Time{}) == nil {
+		return bufio.NewReader(in)
+	}
+	return bufio.NewReader(&cancelReader{in: in, done: done, abandon: abandon})
+}
+
+func (r *cancelReader) Read(p []byte) (int, error) {
+	if len(r.rest) > 0 {
+		n := copy(p, r.rest)
+		r.rest = r.rest[n:]
+		return n, nil
+	}
+	if r.err != nil {
+		err := r.err
+		r.err = nil
+		return 0, err
+	}
+	select {
+	case <-r.done:
+		return 0, errEnded
+	default:
+	}
+	if r.pending == nil {
+		// the read has its own buffer, as it may finish after this one returns
+		buf := make([]byte, len(p))
+		result := make(chan readResult, 1)
+		go func() {
+			n, err := r.in.Read(buf)
+			result <- readResult{data: buf[:n], err: err}
+		}()
+		r.pending = result
+	}
+	select {
+	case res := <-r.pending:
+		r.pending = nil
+		n := copy(p, res.data)
+		if n < len(res.data) {
+			r.rest, r.err = res.data[n:], res.err
+			return n, nil
+		}
+		return n, res.err
+	case <-r.done:
+		return 0, errEnded
+	case <-r.abandon:
+		select {
+		case <-r.pending:
+			// what was read before the read was abandoned is discarded
+			r.pending = nil
+		default:
+		}
+		return 0, errAbandoned
+	}
+}
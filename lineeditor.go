@@ -0,0 +1,277 @@
+package shellwrapper
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	keyCtrlA          = 1
+	keyCtrlC          = 3
+	keyCtrlD          = 4
+	keyCtrlE          = 5
+	keyBackspace      = 8
+	keyTab            = 9
+	keyLineFeed       = 10
+	keyCtrlK          = 11
+	keyCarriageReturn = 13
+	keyCtrlN          = 14
+	keyCtrlP          = 16
+	keyCtrlU          = 21
+	keyEscape         = 27
+	keyDelete         = 127
+)
+
+// lineEditor reads a line from the keys typed by the user when the input
+// is a TTY, echoing the line as it is edited
+type lineEditor struct {
+	keys     *bufio.Reader
+	out      io.Writer
+	line     []rune
+	pos      int
+	skipFeed bool
+	history  []string
+	recall   int
+	draft    []rune
+	hidden   bool
+}
+
+func newLineEditor(keys io.Reader, out io.Writer) *lineEditor {
+	return &lineEditor{
+		keys: bufio.NewReader(keys),
+		out:  out,
+		line: make([]rune, 0),
+	}
+}
+
+// readLine returns the line typed by the user; completions are the
+// inputs offered when the user presses tab, and history the lines
+// (oldest first) recalled with the up and down arrows
+func (l *lineEditor) readLine(completions, history []string) (string, error) {
+	l.line, l.pos = l.line[:0], 0
+	l.history, l.recall = history, len(history)
+	for {
+		r, _, err := l.keys.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		// a carriage return followed by a line feed is one key
+		if l.skipFeed && r == keyLineFeed {
+			l.skipFeed = false
+			continue
+		}
+		l.skipFeed = false
+		switch r {
+		case keyCarriageReturn, keyLineFeed:
+			l.skipFeed = r == keyCarriageReturn
+			fmt.Fprint(l.out, "\n")
+			return string(l.line), nil
+		case keyCtrlC:
+			fmt.Fprint(l.out, "^C\n")
+			return "", errInterrupt
+		case keyCtrlD:
+			if len(l.line) < 1 {
+				fmt.Fprint(l.out, "\n")
+				return "", io.EOF
+			}
+			l.delete()
+		case keyBackspace, keyDelete:
+			l.backspace()
+		case keyTab:
+			if !l.hidden {
+				l.complete(completions)
+			}
+		case keyCtrlA:
+			l.moveTo(0)
+		case keyCtrlE:
+			l.moveTo(len(l.line))
+		case keyCtrlK:
+			l.line = l.line[:l.pos]
+			l.redraw()
+		case keyCtrlU:
+			l.line, l.pos = l.line[:0], 0
+			l.redraw()
+		case keyCtrlP:
+			l.recallLine(l.recall - 1)
+		case keyCtrlN:
+			l.recallLine(l.recall + 1)
+		case keyEscape:
+			if err := l.escape(); err != nil {
+				return "", err
+			}
+		default:
+			if unicode.IsPrint(r) {
+				l.insert(r)
+			}
+		}
+	}
+}
+
+// readHidden returns a line typed by the user without echoing it, for
+// passwords and the like; the editor's copy of the line is zeroed
+func (l *lineEditor) readHidden() (string, error) {
+	l.hidden = true
+	defer func() {
+		l.hidden = false
+		line := l.line[:cap(l.line)]
+		for i := range line {
+			line[i] = 0
+		}
+	}()
+	return l.readLine(nil, nil)
+}
+
+// escape handles the escape sequences sent by the arrow, home,
+// end and delete keys
+func (l *lineEditor) escape() error {
+	r, _, err := l.keys.ReadRune()
+	if err != nil {
+		return err
+	}
+	if r != '[' && r != 'O' {
+		return nil
+	}
+	var params string
+	for {
+		r, _, err = l.keys.ReadRune()
+		if err != nil {
+			return err
+		}
+		if r >= '@' && r <= '~' {
+			break
+		}
+		params += string(r)
+	}
+	switch {
+	case r == 'A':
+		l.recallLine(l.recall - 1)
+	case r == 'B':
+		l.recallLine(l.recall + 1)
+	case r == 'C':
+		l.moveTo(l.pos + 1)
+	case r == 'D':
+		l.moveTo(l.pos - 1)
+	case r == 'H' || (r == '~' && (params == "1" || params == "7")):
+		l.moveTo(0)
+	case r == 'F' || (r == '~' && (params == "4" || params == "8")):
+		l.moveTo(len(l.line))
+	case r == '~' && params == "3":
+		l.delete()
+	}
+	return nil
+}
+
+func (l *lineEditor) insert(r rune) {
+	l.line = append(l.line, 0)
+	copy(l.line[l.pos+1:], l.line[l.pos:])
+	l.line[l.pos] = r
+	l.pos++
+	l.redraw()
+}
+
+func (l *lineEditor) backspace() {
+	if l.pos < 1 {
+		return
+	}
+	l.line = append(l.line[:l.pos-1], l.line[l.pos:]...)
+	l.pos--
+	l.redraw()
+}
+
+func (l *lineEditor) delete() {
+	if l.pos >= len(l.line) {
+		return
+	}
+	l.line = append(l.line[:l.pos], l.line[l.pos+1:]...)
+	l.redraw()
+}
+
+func (l *lineEditor) moveTo(pos int) {
+	if pos < 0 || pos > len(l.line) {
+		return
+	}
+	l.pos = pos
+	l.redraw()
+}
+
+// recallLine replaces the line with the history entry i; the line being
+// typed before the history was recalled comes after the last entry
+func (l *lineEditor) recallLine(i int) {
+	if i < 0 || i > len(l.history) {
+		return
+	}
+	if l.recall == len(l.history) {
+		l.draft = append(l.draft[:0], l.line...)
+	}
+	l.recall = i
+	if i == len(l.history) {
+		l.line = append(l.line[:0], l.draft...)
+	} else {
+		l.line = append(l.line[:0], []rune(l.history[i])...)
+	}
+	l.pos = len(l.line)
+	l.redraw()
+}
+
+// replace replaces the line before the cursor with text
+func (l *lineEditor) replace(text string) {
+	l.line = append([]rune(text), l.line[l.pos:]...)
+	l.pos = len([]rune(text))
+	l.redraw()
+}
+
+// complete completes the line before the cursor to the longest prefix
+// shared by the matching completions, listing them if it is ambiguous
+func (l *lineEditor) complete(completions []string) {
+	prefix := string(l.line[:l.pos])
+	matches := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, completion := range completions {
+		if strings.HasPrefix(completion, prefix) && !seen[completion] {
+			seen[completion] = true
+			matches = append(matches, completion)
+		}
+	}
+	sort.Strings(matches)
+	switch len(matches) {
+	case 0:
+		fmt.Fprint(l.out, "\a")
+	case 1:
+		l.replace(matches[0])
+	default:
+		if common := commonPrefix(matches); len(common) > len(prefix) {
+			l.replace(common)
+			return
+		}
+		fmt.Fprintf(l.out, "\n%s\n", strings.Join(matches, "  "))
+		l.redraw()
+	}
+}
+
+// redraw draws the line over the current one and puts the cursor back
+func (l *lineEditor) redraw() {
+	if l.hidden {
+		return
+	}
+	fmt.Fprintf(l.out, "\r%s\x1b[K", string(l.line))
+	if back := len(l.line) - l.pos; back > 0 {
+		fmt.Fprintf(l.out, "\x1b[%dD", back)
+	}
+}
+
+func commonPrefix(words []string) string {
+	prefix := []rune(words[0])
+	for _, word := range words[1:] {
+		runes := []rune(word)
+		i := 0
+		for i < len(prefix) && i < len(runes) && prefix[i] == runes[i] {
+			i++
+		}
+		prefix = prefix[:i]
+	}
+	return string(prefix)
+}
@@ -0,0 +1,87 @@
+package shellwrapper
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLineEditor(t *testing.T) {
+	completions := []string{"yes", "y", "no", "install", "inspect", QUIT, EXIT}
+	history := []string{"install", "yes", "no"}
+	tests := []struct {
+		name   string
+		keys   string
+		expect string
+		err    error
+		output string
+	}{
+		{name: "plain line", keys: "hello\n", expect: "hello"},
+		{name: "carriage return", keys: "hello\r\n", expect: "hello"},
+		{name: "backspace", keys: "helo\x7f\x7fllo\n", expect: "hello"},
+		{name: "arrows", keys: "hllo\x1b[D\x1b[D\x1b[D\x1b[D\x1b[Ce\n", expect: "hello"},
+		{name: "home and end", keys: "ello\x1b[Hh\x1b[F!\n", expect: "hello!"},
+		{name: "delete", keys: "hxello\x01\x1b[C\x1b[3~\n", expect: "hello"},
+		{name: "clear line", keys: "goodbye\x15hello\n", expect: "hello"},
+		{name: "unique completion", keys: "n\t\n", expect: "no"},
+		{name: "common prefix", keys: "ins\tt\t\n", expect: "install"},
+		{name: "ambiguous", keys: "e\t\n", expect: "exit"},
+		{name: "listing", keys: "ins\t\t\n", expect: "ins", output: "\ninspect  install\n"},
+		{name: "no completion", keys: "z\t\n", expect: "z", output: "\a"},
+		{name: "history", keys: "\x1b[A\x1b[A\n", expect: "yes"},
+		{name: "history start", keys: "\x1b[A\x1b[A\x1b[A\x1b[A\n", expect: "install"},
+		{name: "history back to draft", keys: "ins\x1b[A\x1b[A\x1b[B\x1b[Bt\n", expect: "inst"},
+		{name: "history edit", keys: "\x10\x10\x0e\x7fope\n", expect: "nope"},
+		{name: "interrupt", keys: "hel\x03", err: errInterrupt},
+		{name: "end of input", keys: "\x04", err: io.EOF},
+	}
+	for _, test := range tests {
+		out := &bytes.Buffer{}
+		editor := newLineEditor(strings.NewReader(test.keys), out)
+		line, err := editor.readLine(completions, history)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.err, err)
+		}
+		if line != test.expect {
+			t.Errorf("%s: expected line '%s', got '%s'", test.name, test.expect, line)
+		}
+		if !strings.Contains(out.String(), test.output) {
+			t.Errorf("%s: expected output to contain %q, got %q", test.name, test.output, out.String())
+		}
+	}
+}
+
+func TestLineEditorHidden(t *testing.T) {
+	out := &bytes.Buffer{}
+	editor := newLineEditor(strings.NewReader("s3cre\x7fet\t\n"), out)
+	line, err := editor.readHidden()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "s3cret" {
+		t.Errorf("expected line 's3cret', got '%s'", line)
+	}
+	if out.String() != "\n" {
+		t.Errorf("expected nothing but a new line to be echoed, got %q", out.String())
+	}
+	for _, r := range editor.line[:cap(editor.line)] {
+		if r != 0 {
+			t.Fatalf("expected the editor's copy of the line to be zeroed, got %q", string(editor.line[:cap(editor.line)]))
+		}
+	}
+}
+
+func TestLineEditorKeepsTypeAhead(t *testing.T) {
+	editor := newLineEditor(strings.NewReader("no\r\nyes\n"), &bytes.Buffer{})
+	for _, expect := range []string{"no", "yes"} {
+		line, err := editor.readLine(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != expect {
+			t.Errorf("expected line '%s', got '%s'", expect, line)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package shellwrapper
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+type (
+	// Option configures a Shell created by NewShell
+	Option func(*config)
+
+	config struct {
+		in              io.Reader
+		out             io.Writer
+		errOut          io.Writer
+		greeting        []string
+		bufferSize      int
+		prompt          string
+		spinnerInterval time.Duration
+		spinnerFrames   []string
+		waitTime        int
+		signals         []os.Signal
+		historyFile     string
+		truthy          []string
+		falsy           []string
+		logger          *slog.Logger
+		gracePeriod     time.Duration
+	}
+)
+
+func defaultConfig() *config {
+	return &config{
+		in:              os.Stdin,
+		out:             os.Stdout,
+		errOut:          os.Stderr,
+		bufferSize:      10,
+		prompt:          "> ",
+		spinnerInterval: time.Millisecond * JITTER_TIME,
+		spinnerFrames:   disp,
+		waitTime:        10 * 1000,
+		signals:         []os.Signal{os.Interrupt},
+		truthy:          []string{"yes", "y", "true", "t", "1"},
+		falsy:           []string{"no", "n", "false", "f", "0"},
+	}
+}
+
+// WithInput sets the source of the user's input (os.Stdin by default)
+func WithInput(in io.Reader) Option {
+	return func(c *config) {
+		c.in = in
+	}
+}
+
+// WithOutput sets the writer that everything the shell displays
+// is written to (os.Stdout by default)
+func WithOutput(out io.Writer) Option {
+	return func(c *config) {
+		c.out = out
+	}
+}
+
+// WithErrorOutput sets the writer that error lines are written
+// to (os.Stderr by default)
+func WithErrorOutput(errOut io.Writer) Option {
+	return func(c *config) {
+		c.errOut = errOut
+	}
+}
+
+// WithGreeting sets the greeting display for your shell programme;
+// each ...string passed is a new line in the greeting
+func WithGreeting(greeting ...string) Option {
+	return func(c *config) {
+		c.greeting = greeting
+	}
+}
+
+// WithBufferSize sets the number of inputs and outputs kept in the
+// shell's Buffer (10 by default)
+func WithBufferSize(bufferSize int) Option {
+	return func(c *config) {
+		c.bufferSize = bufferSize
+	}
+}
+
+// WithPrompt sets the prefix of every line the shell displays ("> " by default)
+func WithPrompt(prompt string) Option {
+	return func(c *config) {
+		c.prompt = prompt
+	}
+}
+
+// WithSpinner sets the frames of the loading spinner displayed next to
+// the loading message of ThenRun, and the interval at which they change
+func WithSpinner(interval time.Duration, frames ...string) Option {
+	return func(c *config) {
+		c.spinnerInterval = interval
+		c.spinnerFrames = frames
+	}
+}
+
+// WithWaitTime sets the default timeout (in milliseconds) of the functions
+// passed to ThenRun with a timeout of 0 (10 seconds by default)
+func WithWaitTime(waitTime int) Option {
+	return func(c *config) {
+		c.waitTime = waitTime
+	}
+}
+
+// WithSignals sets the signals that interrupt the shell (os.Interrupt by
+// default); passing no signals leaves signal handling to the host programme
+func WithSignals(signals ...os.Signal) Option {
+	return func(c *config) {
+		c.signals = signals
+	}
+}
+
+// WithHistoryFile keeps the history of the user's inputs in the file at
+// path (which may start with ~ for the home directory), so that it can be
+// recalled in later sessions; by default the history is kept in memory only
+func WithHistoryFile(path string) Option {
+	return func(c *config) {
+		c.historyFile = path
+	}
+}
+
+// WithBoolAnswers sets the answers accepted as true and false by
+// AskForBool and Confirm, which are matched regardless of case; the first
+// of each is shown to the user (yes, y, true, t and 1, and no, n, false,
+// f and 0 by default)
+func WithBoolAnswers(truthy, falsy []string) Option {
+	return func(c *config) {
+		c.truthy = truthy
+		c.falsy = falsy
+	}
+}
+
+// WithLogger sets the logger returned by Session.Logger to functions
+// passed to ThenRunWithSession; by default the records are displayed
+// above the loading spinner
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *config) {
+		c.logger = logger
+	}
+}
+
+// WithGracePeriod abandons a function passed to ThenRun that has not
+// returned within gracePeriod of timing out or of the session ending,
+// so that the flow can continue; abandoned functions are reported. By
+// default the shell waits for functions to return however long they take
+func WithGracePeriod(gracePeriod time.Duration) Option {
+	return func(c *config) {
+		c.gracePeriod = gracePeriod
+	}
+}
+
+func (c *config) validate() error {
+	errs := make([]error, 0)
+	if c.in == nil {
+		errs = append(errs, errors.New("input must not be nil"))
+	}
+	if c.out == nil {
+		errs = append(errs, errors.New("output must not be nil"))
+	}
+	if c.errOut == nil {
+		errs = append(errs, errors.New("error output must not be nil"))
+	}
+	if c.bufferSize < 1 {
+		errs = append(errs, fmt.Errorf("buffer size must be at least 1, got %d", c.bufferSize))
+	}
+	if c.spinnerInterval <= 0 {
+		errs = append(errs, fmt.Errorf("spinner interval must be positive, got %s", c.spinnerInterval))
+	}
+	if len(c.spinnerFrames) < 1 {
+		errs = append(errs, errors.New("spinner must have at least one frame"))
+	}
+	if c.waitTime < 1 {
+		errs = append(errs, fmt.Errorf("wait time must be at least 1ms, got %d", c.waitTime))
+	}
+	if c.gracePeriod < 0 {
+		errs = append(errs, fmt.Errorf("grace period must not be negative, got %s", c.gracePeriod))
+	}
+	if len(c.truthy) < 1 || len(c.falsy) < 1 {
+		errs = append(errs, errors.New("there must be at least one true and one false answer"))
+	}
+	for _, t := range c.truthy {
+		for _, f := range c.falsy {
+			if strings.EqualFold(t, f) {
+				errs = append(errs, fmt.Errorf("answer '%s' cannot be both true and false", t))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid shell configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
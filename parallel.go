@@ -0,0 +1,265 @@
+package shellwrapper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	taskWaiting taskState = iota
+	taskRunning
+	taskDone
+	taskFailed
+	taskTimedOut
+	taskCanceled
+)
+
+type (
+	// TaskErrors is the error of ThenRunParallel when any of its tasks
+	// fail or time out; it holds the errors of those tasks by their names
+	TaskErrors map[string]error
+
+	// parallelRun holds the settings of a ThenRunParallel event
+	parallelRun struct {
+		tasks          map[string]ExecFunc
+		maxConcurrency int
+		failFast       bool
+	}
+
+	// task is one of the functions run by ThenRunParallel; mu guards its
+	// state and error, which are displayed while it runs
+	task struct {
+		mu    sync.Mutex
+		name  string
+		run   ExecFunc
+		state taskState
+		err   error
+	}
+
+	taskState int
+)
+
+// ThenRunParallel runs the tasks, which are named by the keys of tasks,
+// at the same time; each is displayed on a line of its own with its state.
+// At most maxConcurrency tasks run at once (all of them if it is 0), and
+// each has the timeout, which is the flow's WaitTime if it is 0. The flow
+// continues once all the tasks have finished, or once the first fails if
+// ThenRunParallel is followed by FailFast. If any fail the error is a
+// TaskErrors, and OnError and OnSuccess may follow as with ThenRun
+func (s *Shell) ThenRunParallel(tasks map[string]ExecFunc, timeout uint, maxConcurrency int) *Shell {
+	flow := s.getFlow()
+	if len(tasks) < 1 {
+		flow.problems = append(flow.problems, errors.New("ThenRunParallel has no tasks"))
+	}
+	for name, f := range tasks {
+		if f == nil {
+			flow.problems = append(flow.problems, fmt.Errorf("task '%s' of ThenRunParallel is nil", name))
+		}
+	}
+	if maxConcurrency < 0 {
+		flow.problems = append(flow.problems, fmt.Errorf("ThenRunParallel cannot run %d tasks at once", maxConcurrency))
+	}
+	p := &parallelRun{tasks: tasks, maxConcurrency: maxConcurrency}
+	step := s.addRun(func(timeout uint, _ string) error {
+		return s.runParallel(p, timeout)
+	}, timeout)
+	step.parallel = p
+	return s
+}
+
+// FailFast makes the preceding ThenRunParallel cancel the tasks that are
+// still running or waiting once one fails; the flow continues when the
+// tasks that are running have returned
+func (s *Shell) FailFast() *Shell {
+	step, ok := s.runStep("FailFast")
+	if !ok {
+		return s
+	}
+	if step.parallel == nil {
+		flow := s.getFlow()
+		flow.problems = append(flow.problems, errors.New("FailFast must directly follow ThenRunParallel"))
+		return s
+	}
+	step.parallel.failFast = true
+	return s
+}
+
+func (e TaskErrors) Error() string {
+	errs := make([]string, 0, len(e))
+	for _, name := range e.names() {
+		errs = append(errs, fmt.Sprintf("%s: %s", name, e[name].Error()))
+	}
+	return strings.Join(errs, "; ")
+}
+
+// Unwrap lets errors.Is and errors.As match the errors of the tasks
+func (e TaskErrors) Unwrap() []error {
+	errs := make([]error, 0, len(e))
+	for _, name := range e.names() {
+		errs = append(errs, e[name])
+	}
+	return errs
+}
+
+func (e TaskErrors) names() []string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// runParallel runs the tasks, displaying their states until all have
+// returned
+func (s *Shell) runParallel(p *parallelRun, timeout uint) error {
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	names := make([]string, 0, len(p.tasks))
+	for name := range p.tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tasks := make([]*task, 0, len(names))
+	for _, name := range names {
+		tasks = append(tasks, &task{name: name, run: p.tasks[name]})
+	}
+	limit := p.maxConcurrency
+	if limit < 1 {
+		limit = len(tasks)
+	}
+	slots := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for _, t := range tasks {
+		wg.Add(1)
+		go func(t *task) {
+			defer wg.Done()
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				t.set(taskCanceled, ctx.Err())
+				return
+			}
+			defer func() { <-slots }()
+			if ctx.Err() != nil {
+				t.set(taskCanceled, ctx.Err())
+				return
+			}
+			if !s.runTask(t, ctx, timeout) && p.failFast {
+				cancel()
+			}
+		}(t)
+	}
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	s.displayTasks(tasks, finished)
+	errs := make(TaskErrors)
+	for _, t := range tasks {
+		if t.state == taskFailed || t.state == taskTimedOut {
+			errs[t.name] = t.err
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// displayTasks displays the state of each task until finished is closed
+func (s *Shell) displayTasks(tasks []*task, finished <-chan struct{}) {
+	defer s.writer.Flush()
+	load := time.NewTicker(s.spinnerInterval)
+	defer load.Stop()
+	var pos int
+	for {
+		select {
+		case <-load.C:
+			s.Display(s.taskLines(tasks, s.spinnerFrames[pos]), true)
+			pos = (pos + 1) % len(s.spinnerFrames)
+		case <-finished:
+			s.Display(s.taskLines(tasks, ""), true)
+			return
+		}
+	}
+}
+
+func (s *Shell) taskLines(tasks []*task, frame string) string {
+	lines := make([]string, 0, len(tasks))
+	for _, t := range tasks {
+		lines = append(lines, fmt.Sprintf("%s%s %s", s.prompt, t.name, t.status(frame)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// runTask runs the task with the timeout; it returns false if the task
+// failed or timed out
+func (s *Shell) runTask(t *task, parent context.Context, timeout uint) bool {
+	t.set(taskRunning, nil)
+	ctx, cancel := context.WithTimeout(parent, time.Duration(timeout)*time.Millisecond)
+	defer cancel()
+	returned, err := s.call(ctx, func() error {
+		return t.run(ctx, cancel)
+	})
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		after := time.Duration(timeout) * time.Millisecond
+		switch {
+		case !returned:
+			err = fmt.Errorf("%w after %s and was abandoned", ErrTimeout, after)
+		case err == nil:
+			err = fmt.Errorf("%w after %s", ErrTimeout, after)
+		default:
+			err = fmt.Errorf("%w after %s (%w)", ErrTimeout, after, err)
+		}
+		t.set(taskTimedOut, err)
+		return false
+	case !returned:
+		t.set(taskCanceled, fmt.Errorf("abandoned after %s", s.gracePeriod))
+		return true
+	case err == nil:
+		t.set(taskDone, nil)
+		return true
+	case parent.Err() != nil:
+		// another task failed or the session ended
+		t.set(taskCanceled, err)
+		return true
+	default:
+		t.set(taskFailed, err)
+		return false
+	}
+}
+
+func (t *task) set(state taskState, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.state, t.err = state, err
+}
+
+// status describes the state of the task; frame is the spinner's frame
+// for a task that is running
+func (t *task) status(frame string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch t.state {
+	case taskWaiting:
+		return " ...waiting"
+	case taskRunning:
+		return frame
+	case taskDone:
+		return " ...done"
+	case taskTimedOut:
+		return " ...timed out"
+	case taskCanceled:
+		return " ...cancelled"
+	default:
+		return fmt.Sprintf(" ...error (%s)", t.err.Error())
+	}
+}
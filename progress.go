@@ -0,0 +1,135 @@
+package shellwrapper
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// progressWidth is the number of characters in a progress bar
+	progressWidth = 20
+	// progressLineInterval is the least time between the lines that report
+	// progress when the output is not a TTY
+	progressLineInterval = time.Second
+)
+
+type (
+	// ProgressFunc is a function passed to ThenRunWithProgress
+	ProgressFunc func(context.Context, *Progress) error
+
+	// Progress reports how far along a running function is; it is
+	// displayed in place of the spinner as a bar with the percentage done,
+	// the throughput and the time left, or as a line every so often if the
+	// output is not a TTY. Its methods may be called from any goroutine
+	Progress struct {
+		mu         sync.Mutex
+		jitter     *jitter
+		total      int64
+		done       int64
+		started    time.Time
+		reported   int64
+		reportedAt time.Time
+	}
+)
+
+// ThenRunWithProgress is like ThenRun, but f is given a Progress with
+// which to report how far along it is
+func (s *Shell) ThenRunWithProgress(f ProgressFunc, loadingMessage string, timeout uint) *Shell {
+	return s.thenRun(func(j *jitter) error {
+		return f(j.ctx, j.trackProgress())
+	}, loadingMessage, timeout)
+}
+
+// Progress returns the progress of the function, which is displayed in
+// place of the spinner from the first time it is called
+func (sess *Session) Progress() *Progress {
+	return sess.jitter.trackProgress()
+}
+
+// trackProgress returns the progress of the jitter's function, which is
+// displayed from then on
+func (j *jitter) trackProgress() *Progress {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.progress == nil {
+		j.progress = &Progress{jitter: j, started: time.Now(), reported: -1}
+	}
+	return j.progress
+}
+
+// SetTotal sets the amount of work to be done, such as the number of
+// bytes to download; if it is not set (or is 0) the amount done so far
+// is displayed without a percentage
+func (p *Progress) SetTotal(total int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total = total
+}
+
+// Add adds n to the amount of work done
+func (p *Progress) Add(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += n
+}
+
+// SetMessage replaces the loading message displayed with the progress
+func (p *Progress) SetMessage(message string) {
+	p.jitter.setStatus(message)
+}
+
+// bar returns the progress as a bar, or with frame of the spinner if
+// the total is not known
+func (p *Progress) bar(frame string, now time.Time) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.total < 1 {
+		return frame + " " + p.report(now)
+	}
+	filled := progressWidth * p.percent() / 100
+	return fmt.Sprintf("[%s%s] %s", strings.Repeat("#", filled), strings.Repeat("-", progressWidth-filled), p.report(now))
+}
+
+// line returns the progress to be displayed as a line of its own; ok
+// is false if it has not changed, or was displayed too recently
+func (p *Progress) line(now time.Time) (line string, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done == p.reported || now.Sub(p.reportedAt) < progressLineInterval {
+		return "", false
+	}
+	p.reported, p.reportedAt = p.done, now
+	return p.report(now), true
+}
+
+// report describes the progress, for example 50% 512/1024 12.5/s ETA 41s
+func (p *Progress) report(now time.Time) string {
+	report := fmt.Sprintf("%d", p.done)
+	if p.total > 0 {
+		report = fmt.Sprintf("%d%% %d/%d", p.percent(), p.done, p.total)
+	}
+	elapsed := now.Sub(p.started).Seconds()
+	if elapsed <= 0 || p.done < 1 {
+		return report
+	}
+	rate := float64(p.done) / elapsed
+	report = fmt.Sprintf("%s %.1f/s", report, rate)
+	if p.total > p.done {
+		eta := time.Duration(float64(p.total-p.done) / rate * float64(time.Second))
+		report = fmt.Sprintf("%s ETA %s", report, eta.Round(time.Second))
+	}
+	return report
+}
+
+func (p *Progress) percent() int {
+	if p.done >= p.total {
+		return 100
+	}
+	if p.done < 1 {
+		return 0
+	}
+	return int(p.done * 100 / p.total)
+}
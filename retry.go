@@ -0,0 +1,174 @@
+package shellwrapper
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	retryChoice = "retry"
+	skipChoice  = "skip"
+	abortChoice = "abort"
+
+	// maxRetryDelay limits exponential backoff without a MaxDelay, so
+	// that neither doubling the delay nor adding jitter to it overflows
+	maxRetryDelay = time.Duration(math.MaxInt64 / 2)
+)
+
+// RetryPolicy decides how the function passed to ThenRun is retried
+// when it fails
+type RetryPolicy struct {
+	// MaxAttempts is the most times the function is run, including the first
+	MaxAttempts int
+	// Delay is the time waited before the first retry
+	Delay time.Duration
+	// Exponential doubles the delay before each retry after the first
+	Exponential bool
+	// MaxDelay limits the delay of exponential backoff, if it is set
+	MaxDelay time.Duration
+	// Jitter varies each delay at random by up to this fraction of it,
+	// for example 0.2 for 20% either way
+	Jitter float64
+	// Retryable decides whether an error is retried; by default all are,
+	// apart from errors wrapped with Fatal, which end the session
+	Retryable func(error) bool
+	// Prompt asks the user whether to retry, skip or abort once the last
+	// attempt has failed
+	Prompt bool
+}
+
+// Retry retries the function passed to the preceding ThenRun (or
+// ThenRunWithSession or ThenRunWithProgress) according to policy when it
+// fails; the error of each attempt is displayed, and the spinner shows the
+// attempt that is running. OnError and OnSuccess act on the last attempt
+func (s *Shell) Retry(policy RetryPolicy) *Shell {
+	step, ok := s.runStep("Retry")
+	if !ok {
+		return s
+	}
+	flow := s.getFlow()
+	if step.parallel != nil {
+		flow.problems = append(flow.problems, errors.New("Retry cannot follow ThenRunParallel"))
+		return s
+	}
+	if policy.MaxAttempts < 1 {
+		flow.problems = append(flow.problems, fmt.Errorf("Retry must make at least 1 attempt, got %d", policy.MaxAttempts))
+	}
+	if policy.Delay < 0 || policy.MaxDelay < 0 {
+		flow.problems = append(flow.problems, errors.New("Retry cannot wait for a negative delay"))
+	}
+	if policy.Jitter < 0 || policy.Jitter > 1 {
+		flow.problems = append(flow.problems, fmt.Errorf("the jitter of Retry must be from 0 to 1, got %g", policy.Jitter))
+	}
+	step.retry = &policy
+	return s
+}
+
+// attempt runs the function of step, retrying it as the step's policy
+// allows; ok is false if the session has ended
+func (s *Shell) attempt(step *runStep, run func(uint, string) error, timeout uint) (ok bool, err error) {
+	r := step.retry
+	for n := 1; ; n++ {
+		ok, err = s.runResult(run(timeout, r.attempt(n)))
+		if !ok || err == nil || r == nil {
+			return ok, err
+		}
+		if n < r.MaxAttempts && r.retryable(err) {
+			if !s.backOff(r.delay(n), n+1, r.MaxAttempts) {
+				return false, err
+			}
+			continue
+		}
+		if !r.Prompt {
+			return true, err
+		}
+		switch s.askRetry() {
+		case retryChoice:
+			n = 0
+		case skipChoice:
+			return true, err
+		case abortChoice:
+			s.end(&ExitError{Reason: ErrExecFailed, Err: err})
+			return false, err
+		default:
+			return false, err
+		}
+	}
+}
+
+// backOff waits for delay before the attempt; it returns false if the
+// session ends in the meantime
+func (s *Shell) backOff(delay time.Duration, attempt, attempts int) bool {
+	s.waitForShellOutput("", fmt.Sprintf("%sretrying in %s (attempt %d of %d)", s.prompt, delay.Round(time.Millisecond), attempt, attempts), false, false)
+	wait := time.NewTimer(delay)
+	defer wait.Stop()
+	select {
+	case <-wait.C:
+		return true
+	case <-s.OsInterrupt:
+		s.end(&ExitError{Reason: ErrInterrupted})
+		return false
+	case <-s.cancel:
+		return false
+	}
+}
+
+// askRetry asks the user whether to retry, skip or abort the function
+// that has failed; it returns "" if the session has ended
+func (s *Shell) askRetry() string {
+	q := &question{choices: []string{retryChoice, skipChoice, abortChoice}}
+	defer func() { s.awaitingAnswer, s.asking = "", nil }()
+	s.awaitingAnswer, s.asking = retryChoice, q
+	var choice string
+	err := s.awaitAnyInput(func(command string) bool {
+		if len(command) < 1 {
+			return false
+		}
+		var ok bool
+		if choice, ok = q.choose(command); !ok {
+			s.waitForShellOutput(command, fmt.Sprintf("%sPlease enter %s, %s or %s", s.prompt, retryChoice, skipChoice, abortChoice), false, false)
+		}
+		return ok
+	}, s.prompt+"retry, skip or abort?"+s.menu(q))
+	if err != nil {
+		return ""
+	}
+	return choice
+}
+
+// attempt describes the attempt n for the spinner, if there may be more
+// than one
+func (r *RetryPolicy) attempt(n int) string {
+	if r == nil || r.MaxAttempts < 2 {
+		return ""
+	}
+	return fmt.Sprintf(" (attempt %d of %d)", n, r.MaxAttempts)
+}
+
+func (r *RetryPolicy) retryable(err error) bool {
+	return r.Retryable == nil || r.Retryable(err)
+}
+
+// delay returns the time to wait after the attempt n has failed
+func (r *RetryPolicy) delay(n int) time.Duration {
+	delay := r.Delay
+	if r.Exponential {
+		for i := 1; i < n && (r.MaxDelay == 0 || delay < r.MaxDelay); i++ {
+			if delay > maxRetryDelay/2 {
+				delay = maxRetryDelay
+				break
+			}
+			delay *= 2
+		}
+		if r.MaxDelay > 0 && delay > r.MaxDelay {
+			delay = r.MaxDelay
+		}
+	}
+	if r.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * r.Jitter * float64(delay))
+	}
+	return delay
+}
@@ -0,0 +1,171 @@
+package shellwrapper
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+type (
+	// Session is given to a function passed to ThenRunWithSession; it gives
+	// the function the answers collected so far, lets it ask follow-up
+	// questions, and displays its progress and logs without disturbing the
+	// loading spinner. A Session must not be used once the function returns
+	Session struct {
+		shell  *Shell
+		jitter *jitter
+		writer *lineWriter
+		logger *slog.Logger
+	}
+
+	// lineWriter passes what is written to it to line a line at a time; a
+	// line without a newline is held until the rest of it is written
+	lineWriter struct {
+		mu      sync.Mutex
+		line    func(string)
+		partial []byte
+	}
+)
+
+func (s *Shell) newSession(j *jitter) *Session {
+	sess := &Session{
+		shell:  s,
+		jitter: j,
+		writer: &lineWriter{line: s.print},
+		logger: s.logger,
+	}
+	if sess.logger == nil {
+		sess.logger = slog.New(slog.NewTextHandler(sess.writer, &slog.HandlerOptions{
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				// lines are displayed as they are logged, so the time adds nothing
+				if len(groups) < 1 && a.Key == slog.TimeKey {
+					return slog.Attr{}
+				}
+				return a
+			},
+		}))
+	}
+	return sess
+}
+
+// Context returns the context of the function, which is cancelled when
+// the function times out or the session ends
+func (sess *Session) Context() context.Context {
+	return sess.jitter.ctx
+}
+
+// Cancel cancels the context of the function
+func (sess *Session) Cancel() {
+	sess.jitter.cancel()
+}
+
+// Answers returns the answers collected in the session so far; the
+// function may also store its results with Set
+func (sess *Session) Answers() *Answers {
+	return sess.shell.answers
+}
+
+// Status replaces the loading message displayed next to the spinner
+func (sess *Session) Status(message string) {
+	sess.jitter.setStatus(message)
+}
+
+// Printf displays a line above the loading spinner
+func (sess *Session) Printf(format string, args ...any) {
+	sess.shell.print(fmt.Sprintf(format, args...))
+}
+
+// Writer returns a writer whose output is displayed a line at a time
+// above the loading spinner, for example the output of a command
+func (sess *Session) Writer() io.Writer {
+	return sess.writer
+}
+
+// Logger returns the logger configured with WithLogger; by default the
+// records are displayed above the loading spinner
+func (sess *Session) Logger() *slog.Logger {
+	return sess.logger
+}
+
+// Ask prompts the user with question, which may refer to the answers
+// collected so far as the questions of Ask do, and stores the answer as
+// storeAs. The spinner stops while the user answers, but the time taken
+// counts towards the timeout, which should allow for it. The error is not
+// nil if the function has timed out or the session ends before the user
+// answers; Ask then returns straight away, its read is abandoned, and a
+// line already read for it is discarded, so the next prompt reads a line
+// of its own
+func (sess *Session) Ask(question, storeAs string) (string, error) {
+	s := sess.shell
+	if err := sess.jitter.ctx.Err(); err != nil {
+		return "", err
+	}
+	message, ok := s.render(question)
+	if !ok {
+		return "", s.exitErr
+	}
+	sess.jitter.pause(s)
+	defer sess.jitter.resume()
+	sess.writer.flush()
+	s.print(message)
+	for {
+		s.requestInput(inputRequest{history: s.history.snapshot()})
+		select {
+		case <-s.OsInterrupt:
+			s.end(&ExitError{Reason: ErrInterrupted})
+		case <-s.cancel:
+		case <-sess.jitter.ctx.Done():
+			s.abandonInput()
+			return "", sess.jitter.ctx.Err()
+		case input := <-s.UserInput:
+			s.sanitize(&input)
+			s.capture(&input)
+			s.remember(input)
+			if len(input) > 0 {
+				s.answers.set(storeAs, input, input)
+				return input, nil
+			}
+		}
+		if s.ended() {
+			return "", s.exitErr
+		}
+	}
+}
+
+// end displays what is left in the session's writer once the function
+// has returned
+func (sess *Session) end() {
+	sess.writer.flush()
+}
+
+// print displays msg above the loading spinner of a running function
+func (s *Shell) print(msg string) {
+	<-s.shellOutput(s.writer.Bypass(), "", s.prompt+msg, false, false)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		w.line(strings.TrimSuffix(string(w.partial[:i]), "\r"))
+		w.partial = w.partial[i+1:]
+	}
+}
+
+func (w *lineWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.partial) > 0 {
+		w.line(string(w.partial))
+		w.partial = nil
+	}
+}
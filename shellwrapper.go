@@ -2,16 +2,21 @@ package shellwrapper
 
 import (
 	"bufio"
-	"bytes"
 	"container/list"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"os/signal"
+	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/google/uuid"
@@ -26,7 +31,6 @@ const (
 )
 
 var (
-	Testing          = false
 	disp             = []string{"/", "-", "\\", "|"}
 	errorUUID string = uuid.NewString()
 	exitUUID  string = uuid.NewString()
@@ -34,29 +38,58 @@ var (
 
 type (
 	Shell struct {
-		StdIn          io.Writer
-		Reader         *bufio.Reader
-		OsInterrupt    chan os.Signal
-		UserInput      chan string
-		QuestionInput  chan string
-		LastCaptured   chan string
-		command        string
-		Buffer         *list.List
-		cancel         chan struct{}
-		quit           chan struct{}
-		exited         bool
-		bufferSize     int
-		flow           *Flow
-		branches       map[string]FlowFunc
-		writer         *uilive.Writer
-		wait           chan struct{}
-		awaitingAnswer string
-		shellOutChan   chan bool
-		greeter        []string
-		lastSetInputs  []string
-		qas            map[string]string
-		intQas         map[string]int
-		floatQas       map[string]float64
+		StdIn           io.Writer
+		Reader          *bufio.Reader
+		OsInterrupt     chan os.Signal
+		UserInput       chan string
+		QuestionInput   chan string
+		LastCaptured    chan string
+		command         string
+		Buffer          *list.List
+		ctx             context.Context
+		cancel          chan struct{}
+		endOnce         sync.Once
+		exitErr         error
+		input           io.Reader
+		inputRequests   chan inputRequest
+		terminal        *terminal
+		editor          *lineEditor
+		abandon         chan struct{}
+		abandonDone     chan struct{}
+		pumpDone        chan struct{}
+		exited          bool
+		bufferSize      int
+		flow            *Flow
+		root            *Flow
+		branches        map[string]FlowFunc
+		templates       map[string]*template.Template
+		writer          *uilive.Writer
+		out             io.Writer
+		outTTY          bool
+		errOut          io.Writer
+		prompt          string
+		spinnerInterval time.Duration
+		spinnerFrames   []string
+		waitTime        int
+		truthy          []string
+		falsy           []string
+		wait            chan struct{}
+		awaitingAnswer  string
+		asking          *question
+		lastQuestion    *question
+		lastRun         *runStep
+		history         *history
+		shellOutChan    chan bool
+		outputMu        sync.Mutex
+		logger          *slog.Logger
+		gracePeriod     time.Duration
+		greeter         []string
+		lastSetInputs   []string
+		visited         []*Flow
+		resume          []resumption
+		answers         *Answers
+		parsers         map[reflect.Type]parser
+		secrets         map[string][]byte
 	}
 
 	BufferObject struct {
@@ -68,41 +101,142 @@ type (
 
 	DisplayFunc func() string
 
+	// resumption is where the flow continues once the rules set up
+	// by ThenIf or Switch have run
+	resumption struct {
+		flow    *Flow
+		next    *list.Element
+		visited int
+	}
+
+	// conditional holds the rules set up by a case of ThenIf or Switch,
+	// which are built into flow on the first visit
+	conditional struct {
+		label string
+		build FlowFunc
+		flow  *Flow
+	}
+
+	// runStep holds the settings of a ThenRun event; parallel is set
+	// for ThenRunParallel and exec for ThenExec
+	runStep struct {
+		onError   *conditional
+		onSuccess *conditional
+		parallel  *parallelRun
+		exec      *execStep
+		retry     *RetryPolicy
+		event     *list.Element
+	}
+
+	// question holds the settings of an Ask event
+	question struct {
+		storeAs   string
+		sensitive bool
+		secret    bool
+		options   func() []string
+		choices   []string
+		multiple  bool
+		validate  func(string) error
+		def       string
+		event     *list.Element
+	}
+
+	// jitter displays the loading spinner of a running function, or its
+	// progress if it reports any; mu guards the message, which the
+	// function may change, the progress, and paused, which stops the
+	// spinner while the function asks a question
 	jitter struct {
-		waitFor     int
+		timeout     time.Duration
+		deadline    time.Time
 		message     string
 		cancel      context.CancelFunc
 		ctx         context.Context
 		jitterEnded chan struct{}
 		pos         int
-		count       int
+		mu          sync.Mutex
+		paused      bool
+		progress    *Progress
 	}
 )
 
-// NewShell returns a new pointer to Shell
-func NewShell() *Shell {
-	stdIn, reader := getIO()
+// NewShell returns a new pointer to Shell configured by opts; by default
+// the shell reads from os.Stdin and writes to os.Stdout and os.Stderr.
+// An error is returned if the configuration is invalid
+func NewShell(opts ...Option) (*Shell, error) {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	hist, err := newHistory(cfg.historyFile)
+	if err != nil {
+		return nil, err
+	}
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	return &Shell{
-		UserInput:    make(chan string),
-		StdIn:        stdIn,
-		Reader:       reader,
-		OsInterrupt:  c,
-		LastCaptured: make(chan string, 1),
-		shellOutChan: make(chan bool, 1),
-		cancel:       make(chan struct{}),
-		quit:         make(chan struct{}),
-		Buffer:       list.New(),
-		branches:     make(map[string]FlowFunc),
-		bufferSize:   10,
-		flow:         NewFlow(), // the root node, if you will
-		writer:       getWriter(),
-		wait:         make(chan struct{}),
-		qas:          make(map[string]string),
-		intQas:       make(map[string]int),
-		floatQas:     make(map[string]float64),
+	if len(cfg.signals) > 0 {
+		signal.Notify(c, cfg.signals...)
 	}
+	stdIn, _ := cfg.in.(io.Writer)
+	cancel, abandon := make(chan struct{}), make(chan struct{}, 1)
+	s := &Shell{
+		UserInput:       make(chan string),
+		StdIn:           stdIn,
+		Reader:          inputReader(cfg.in, cancel, abandon),
+		abandon:         abandon,
+		abandonDone:     make(chan struct{}),
+		input:           cfg.in,
+		inputRequests:   make(chan inputRequest),
+		pumpDone:        make(chan struct{}),
+		OsInterrupt:     c,
+		LastCaptured:    make(chan string, 1),
+		shellOutChan:    make(chan bool, 1),
+		ctx:             context.Background(),
+		cancel:          cancel,
+		Buffer:          list.New(),
+		branches:        make(map[string]FlowFunc),
+		templates:       make(map[string]*template.Template),
+		bufferSize:      cfg.bufferSize,
+		greeter:         cfg.greeting,
+		writer:          getWriter(cfg.out),
+		out:             cfg.out,
+		outTTY:          isTerminal(cfg.out),
+		errOut:          cfg.errOut,
+		prompt:          cfg.prompt,
+		spinnerInterval: cfg.spinnerInterval,
+		spinnerFrames:   cfg.spinnerFrames,
+		waitTime:        cfg.waitTime,
+		truthy:          cfg.truthy,
+		falsy:           cfg.falsy,
+		wait:            make(chan struct{}),
+		answers:         newAnswers(),
+		secrets:         make(map[string][]byte),
+		history:         hist,
+		logger:          cfg.logger,
+		gracePeriod:     cfg.gracePeriod,
+	}
+	s.parsers = s.defaultParsers()
+	s.flow = s.newFlow() // the root node, if you will
+	s.root = s.flow
+	if term, ok := openTerminal(cfg.in); ok {
+		s.terminal = term
+		// the editor echoes what is typed to the output, so it is only
+		// used if the user sees the output
+		if s.outTTY {
+			s.editor = newLineEditor(term.reader(s.cancel, abandon), cfg.out)
+		}
+	}
+	return s, nil
+}
+
+// NewShellWithIO returns a new pointer to Shell that reads the user's
+// input from in; everything the shell displays is written to out, apart
+// from error lines, which are written to errOut. If in is neither a file
+// nor has a read deadline (as with io.Pipe), a pending read of it cannot be
+// interrupted: it outlives Start, and what it reads is discarded
+func NewShellWithIO(in io.Reader, out io.Writer, errOut io.Writer, opts ...Option) (*Shell, error) {
+	return NewShell(append([]Option{WithInput(in), WithOutput(out), WithErrorOutput(errOut)}, opts...)...)
 }
 
 // SetGreeting Sets the greeting display for your shell programme
@@ -113,8 +247,12 @@ func (s *Shell) SetGreeting(greeting ...string) *Shell {
 }
 
 // SetBufferSize Sets the buffer size for the programme; a buffer-item is
-// an input or output
+// an input or output. A size below 1 is ignored and reported by Validate
 func (s *Shell) SetBufferSize(bufferSize int) *Shell {
+	if bufferSize < 1 {
+		s.root.problems = append(s.root.problems, fmt.Errorf("buffer size must be at least 1, got %d", bufferSize))
+		return s
+	}
 	s.bufferSize = bufferSize
 	return s
 }
@@ -124,7 +262,7 @@ func (s *Shell) SetBufferSize(bufferSize int) *Shell {
 // set alternatives, for example yes, YES, y and Y
 func (s *Shell) IfUserInputs(input ...string) *Shell {
 	if s.flow == nil {
-		s.flow = NewFlow()
+		s.flow = s.newFlow()
 	}
 	s.lastSetInputs = input
 	if !s.addCommand(input...) {
@@ -132,36 +270,49 @@ func (s *Shell) IfUserInputs(input ...string) *Shell {
 	}
 	s.flow.AddEvent(func(e *list.Element) *list.Element {
 		if err := s.awaitAnyInput(s.handleCommand, ""); err != nil {
-			<-s.exit()
+			return nil
 		}
-		s.runEvents()
-		return e.Next()
+		// handleCommand has swapped in the selected flow
+		return s.flow.Events.Front()
 	})
+	if s.flow.prompt == nil {
+		s.flow.prompt = s.flow.Events.Back()
+	}
 	return s
 }
 
 func (s *Shell) awaitAnyInput(f func(string) bool, message string) error {
 	ok := false
 	for !ok {
-		go s.waitForInput()
+		if !s.instruct() {
+			return errEnded
+		}
 		if len(message) > 0 {
 			s.waitForShellOutput("", message, false, false)
 		}
+		s.requestInput(s.inputRequest())
 		select {
 		case <-s.OsInterrupt:
-			return errors.New("interrupt")
+			s.end(&ExitError{Reason: ErrInterrupted})
+		case <-s.cancel:
 		case input := <-s.UserInput:
-			ok = f(input)
+			ok = f(s.prepareInput(input))
+		}
+		if s.ended() {
+			return errEnded
 		}
 	}
 	return nil
 }
 
 func (s *Shell) addCommand(input ...string) bool {
-	flow := NewFlow()
+	flow := s.newFlow()
 	var commandAdded bool
 	for _, command := range input {
 		s.reservedWord(command)
+		if _, ok := s.flow.Flows[command]; ok {
+			s.flow.problems = append(s.flow.problems, fmt.Errorf("duplicate command '%s'", command))
+		}
 		if !commandAdded {
 			s.flow.BaseCommands = append(s.flow.BaseCommands, command)
 			s.command = command
@@ -191,33 +342,175 @@ func (s *Shell) Default(def string) *Shell {
 }
 
 // FirstInstruction Sets the first instruction that will appear in the shell
-// For example 'what is your name?'
+// For example 'what is your name?'. Like the messages of ThenBranch, GoTo,
+// ThenQuit and the Ask functions, it may refer to earlier answers as
+// {{.storeAs}}, which are filled in when it is displayed
 func (s *Shell) FirstInstruction(instruction string) *Shell {
+	s.checkTemplate(instruction)
 	s.getFlow().Instruction = instruction
 	return s
 }
 
-// ThenRun runs the passed function f after a condition has been met
+// ThenRun runs the passed function f after a condition has been met;
+// if timeout is 0 the flow's WaitTime is used. It may be followed by
+// OnError and OnSuccess to decide what happens next
 func (s *Shell) ThenRun(f ExecFunc, loadingMessage string, timeout uint) *Shell {
-	s.getFlow().AddEvent(func(e *list.Element) *list.Element {
-		s.runExec(f, loadingMessage, timeout)
-		return s.nextEvent(e)
+	return s.thenRun(func(j *jitter) error {
+		return f(j.ctx, j.cancel)
+	}, loadingMessage, timeout)
+}
+
+// ThenRunWithSession is like ThenRun, but f is given the Session it runs
+// in, through which it can read the answers, ask follow-up questions,
+// report its progress and log
+func (s *Shell) ThenRunWithSession(f SessionFunc, loadingMessage string, timeout uint) *Shell {
+	return s.thenRun(func(j *jitter) error {
+		sess := s.newSession(j)
+		defer sess.end()
+		return f(sess)
+	}, loadingMessage, timeout)
+}
+
+func (s *Shell) thenRun(f func(*jitter) error, loadingMessage string, timeout uint) *Shell {
+	s.addRun(func(timeout uint, attempt string) error {
+		return s.runFunc(int(timeout), loadingMessage+attempt, f)
+	}, timeout)
+	return s
+}
+
+// addRun adds an event that calls run with the timeout, which is the
+// flow's WaitTime if timeout is 0, and a description of the attempt if
+// the step is retried
+func (s *Shell) addRun(run func(timeout uint, attempt string) error, timeout uint) *runStep {
+	step := &runStep{}
+	flow := s.getFlow()
+	flow.AddEvent(func(e *list.Element) *list.Element {
+		if timeout == 0 {
+			timeout = uint(flow.WaitTime)
+		}
+		ok, err := s.attempt(step, run, timeout)
+		if !ok {
+			return nil
+		}
+		if err != nil {
+			return s.enter(step.onError, e)
+		}
+		return s.enter(step.onSuccess, e)
 	})
+	step.event = flow.Events.Back()
+	s.lastRun = step
+	return step
+}
+
+// OnError runs the rules set up by f if the function passed to the
+// preceding ThenRun returns an error, for example to route the user into
+// a recovery branch; the flow then continues with the events that follow
+// ThenRun. Errors wrapped with Fatal still end the session
+func (s *Shell) OnError(f FlowFunc) *Shell {
+	if step, ok := s.runStep("OnError"); ok {
+		step.onError = s.rules("OnError", "on error", f)
+	}
 	return s
 }
 
+// OnSuccess runs the rules set up by f if the function passed to the
+// preceding ThenRun succeeds; the flow then continues with the events
+// that follow ThenRun
+func (s *Shell) OnSuccess(f FlowFunc) *Shell {
+	if step, ok := s.runStep("OnSuccess"); ok {
+		step.onSuccess = s.rules("OnSuccess", "on success", f)
+	}
+	return s
+}
+
+// runStep returns the ThenRun that the modifier name follows
+func (s *Shell) runStep(name string) (*runStep, bool) {
+	flow := s.getFlow()
+	if s.lastRun == nil || flow.Events.Back() != s.lastRun.event {
+		flow.problems = append(flow.problems, fmt.Errorf("%s must directly follow ThenRun", name))
+		return nil, false
+	}
+	return s.lastRun, true
+}
+
+// rules returns the rules set up by f for the builder function step,
+// which are validated as the flow labelled label
+func (s *Shell) rules(step, label string, f FlowFunc) *conditional {
+	if f != nil {
+		flow := s.getFlow()
+		flow.links = append(flow.links, flowLink{build: f, step: step, label: label})
+	}
+	return &conditional{label: label, build: f}
+}
+
 // ThenBranch runs the callback function f after a condition has been met.
 // The function f should contain further branching rules
 func (s *Shell) ThenBranch(instruction string, f FlowFunc) *Shell {
-	s.getFlow().AddEvent(func(e *list.Element) *list.Element {
+	var built bool
+	s.checkTemplate(instruction)
+	flow := s.getFlow()
+	flow.links = append(flow.links, flowLink{build: f, step: "ThenBranch"})
+	flow.AddEvent(func(e *list.Element) *list.Element {
 		s.command = ""
 		s.getFlow().Instruction = instruction
-		f()
+		if !built {
+			// a flow re-entered after going back keeps the rules built on the first visit
+			built = true
+			f()
+		}
 		return s.nextEvent(e)
 	})
 	return s
 }
 
+// ThenIf runs the rules set up by then if cond returns true when the flow
+// reaches it, or those set up by otherwise if it returns false; either may
+// be nil. The rules are run as a flow of their own, after which the flow
+// continues with the events that follow ThenIf
+func (s *Shell) ThenIf(cond func(*Shell) bool, then FlowFunc, otherwise FlowFunc) *Shell {
+	flow := s.getFlow()
+	if cond == nil {
+		flow.problems = append(flow.problems, errors.New("ThenIf has no condition"))
+		return s
+	}
+	ifTrue, ifFalse := s.rules("ThenIf", "then", then), s.rules("ThenIf", "otherwise", otherwise)
+	flow.AddEvent(func(e *list.Element) *list.Element {
+		if cond(s) {
+			return s.enter(ifTrue, e)
+		}
+		return s.enter(ifFalse, e)
+	})
+	return s
+}
+
+// Switch runs the rules set up by the case matching the answer stored as
+// storedAs, or those set up by otherwise (which may be nil) if no case
+// matches or there is no answer. The answer is matched as its value is
+// printed by fmt.Sprint, for example true or false for AskForBool. As with
+// ThenIf, the flow continues with the events that follow Switch
+func (s *Shell) Switch(storedAs string, cases map[string]FlowFunc, otherwise FlowFunc) *Shell {
+	flow := s.getFlow()
+	values := make([]string, 0, len(cases))
+	for value := range cases {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	branches := make(map[string]*conditional, len(cases))
+	for _, value := range values {
+		branches[value] = s.rules("Switch", fmt.Sprintf("case '%s'", value), cases[value])
+	}
+	fallback := s.rules("Switch", "otherwise", otherwise)
+	flow.AddEvent(func(e *list.Element) *list.Element {
+		if answer, ok := s.answers.Get(storedAs); ok {
+			if c, ok := branches[fmt.Sprint(answer.Value)]; ok {
+				return s.enter(c, e)
+			}
+		}
+		return s.enter(fallback, e)
+	})
+	return s
+}
+
 // Branch lets the programmer create a branch in memory that can
 // be visited at a later stage using the function GoTo
 func (s *Shell) Branch(name string, f FlowFunc) *Shell {
@@ -228,7 +521,7 @@ func (s *Shell) Branch(name string, f FlowFunc) *Shell {
 // ThenDisplay schedules a display event
 func (s *Shell) ThenDisplay(display DisplayFunc) *Shell {
 	s.getFlow().AddEvent(func(e *list.Element) *list.Element {
-		s.waitForShellOutput("display_event", "> "+display(), false, false)
+		s.waitForShellOutput("display_event", s.prompt+display(), false, false)
 		return s.nextEvent(e)
 	})
 	return s
@@ -236,16 +529,25 @@ func (s *Shell) ThenDisplay(display DisplayFunc) *Shell {
 
 // GoTo lets the programmer specify a "go to" on saved Branches,
 // so that branching rules can be applied in multiple contexts
-// after a condition has been met
+// after a condition has been met. The branch may be set up
+// before or after the GoTo
 func (s *Shell) GoTo(name string, instruction string) *Shell {
-	branch, ok := s.branches[name]
-	if !ok {
-		s.ThenQuit(fmt.Sprintf("branch '%s' not found", name))
-	}
-	s.getFlow().AddEvent(func(e *list.Element) *list.Element {
+	var built bool
+	s.checkTemplate(instruction)
+	flow := s.getFlow()
+	flow.links = append(flow.links, flowLink{branch: name})
+	flow.AddEvent(func(e *list.Element) *list.Element {
+		branch, ok := s.branches[name]
+		if !ok {
+			s.fail(ErrMisconfigured, fmt.Errorf("branch '%s' not found", name))
+			return nil
+		}
 		s.command = ""
 		s.getFlow().Instruction = instruction
-		branch()
+		if !built {
+			built = true
+			branch()
+		}
 		return s.nextEvent(e)
 	})
 	return s
@@ -253,10 +555,15 @@ func (s *Shell) GoTo(name string, instruction string) *Shell {
 
 // ThenQuit quits the programme after some condition has been met
 func (s *Shell) ThenQuit(message string) *Shell {
+	s.checkTemplate(message)
 	s.getFlow().AddEvent(func(e *list.Element) *list.Element {
-		s.Display("> "+message, false)
+		message, ok := s.render(message)
+		if !ok {
+			return nil
+		}
+		s.Display(s.prompt+message, false)
 		s.exited = true
-		<-s.exit()
+		s.end(nil)
 		return nil
 	})
 	return s
@@ -274,6 +581,27 @@ func (s *Shell) Ask(question, storeAs string) *Shell {
 	return s.ask(question, storeAs, s.handleAnswer)
 }
 
+// Sensitive keeps the answer to the preceding Ask out of the history
+// of the user's inputs, for example Ask("API key?", "key").Sensitive()
+func (s *Shell) Sensitive() *Shell {
+	flow := s.getFlow()
+	if s.lastQuestion == nil || flow.Events.Back() != s.lastQuestion.event {
+		flow.problems = append(flow.problems, errors.New("Sensitive must directly follow an Ask"))
+		return s
+	}
+	s.lastQuestion.sensitive = true
+	return s
+}
+
+// AskSecret prompts the user for a string, such as a password or token,
+// without echoing it if the input is a TTY. The answer is kept out of the
+// Buffer, the history and LastCaptured, and is only available from GetSecret
+func (s *Shell) AskSecret(question, storeAs string) *Shell {
+	s.ask(question, storeAs, s.handleSecretAnswer)
+	s.lastQuestion.secret = true
+	return s
+}
+
 // AskForInt promps the user for an integer value
 // If the user's input is unacceptable then they will be prompted again
 func (s *Shell) AskForInt(question, storeAs string) *Shell {
@@ -286,37 +614,184 @@ func (s *Shell) AskForFloat(question, storeAs string) *Shell {
 	return s.ask(question, storeAs, s.handleFloatAnswer)
 }
 
-// Start starts the shell programme
-func (s *Shell) Start() {
-	go s.running()
-	<-s.cancel
-	s.Display("> exiting...", false)
+// Start starts the shell programme and returns once the session has
+// ended. The error is nil if the flow came to an end or ThenQuit was
+// reached; otherwise it is an *ExitError describing why the session ended.
+// No goroutine reading the input outlives Start, unless the input cannot
+// be interrupted (see NewShellWithIO)
+func (s *Shell) Start() error {
+	return s.Run(context.Background())
+}
+
+// Run is like Start, but the session also ends when ctx is cancelled:
+// a pending prompt is abandoned and the context passed to a running
+// ExecFunc is cancelled. The error then has the reason ErrCanceled
+func (s *Shell) Run(ctx context.Context) error {
+	if err := s.validate(); err != nil {
+		for _, problem := range err.Problems {
+			s.waitForShellError(errorUUID, s.prompt+problem.Error())
+		}
+		signal.Stop(s.OsInterrupt)
+		return &ExitError{Reason: ErrMisconfigured, Err: err}
+	}
+	s.ctx = ctx
+	s.writer.Start()
+	watched := make(chan struct{})
+	go func() {
+		s.watch(ctx)
+		close(watched)
+	}()
+	go s.pumpInput()
+	s.running()
+	s.Display(s.prompt+"exiting...", false)
 	s.writer.Stop()
+	signal.Stop(s.OsInterrupt)
+	s.stopInput()
+	<-watched
+	return s.exitErr
+}
+
+// AskWithDefault promps the user for any string; def is shown with the
+// question and is the answer if the user just hits return
+func (s *Shell) AskWithDefault(question, storeAs, def string) *Shell {
+	if len(def) < 1 {
+		flow := s.getFlow()
+		flow.problems = append(flow.problems, fmt.Errorf("the default answer for '%s' is empty", storeAs))
+	}
+	return s.askWithDefault(question, storeAs, def, s.handleAnswer)
+}
+
+// AskForIntWithDefault promps the user for an integer value; def is shown
+// with the question and is the answer if the user just hits return
+func (s *Shell) AskForIntWithDefault(question, storeAs string, def int) *Shell {
+	return s.askWithDefault(question, storeAs, strconv.Itoa(def), s.handleIntAnswer)
+}
+
+// AskForFloatWithDefault promps the user for a float value; def is shown
+// with the question and is the answer if the user just hits return
+func (s *Shell) AskForFloatWithDefault(question, storeAs string, def float64) *Shell {
+	return s.askWithDefault(question, storeAs, strconv.FormatFloat(def, 'f', -1, 64), s.handleFloatAnswer)
+}
+
+// AskWithValidator promps the user for a string that is accepted by
+// validate; if validate returns an error, its text is displayed and
+// the user is prompted again
+func (s *Shell) AskWithValidator(question, storeAs string, validate func(string) error) *Shell {
+	s.ask(question, storeAs, s.handleAnswer)
+	s.lastQuestion.validate = validate
+	return s
+}
+
+// AskMatching promps the user for a string that matches the regular
+// expression pattern. If the user's input is unacceptable then they
+// will be prompted again
+func (s *Shell) AskMatching(question, storeAs, pattern string) *Shell {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		flow := s.getFlow()
+		flow.problems = append(flow.problems, fmt.Errorf("invalid pattern for '%s': %w", storeAs, err))
+		return s.Ask(question, storeAs)
+	}
+	return s.AskWithValidator(question, storeAs, func(answer string) error {
+		if !re.MatchString(answer) {
+			return fmt.Errorf("Please enter a value matching %s", pattern)
+		}
+		return nil
+	})
+}
+
+// AskForIntInRange promps the user for an integer value from min to max
+// If the user's input is unacceptable then they will be prompted again
+func (s *Shell) AskForIntInRange(question, storeAs string, min, max int) *Shell {
+	if min > max {
+		flow := s.getFlow()
+		flow.problems = append(flow.problems, fmt.Errorf("invalid range for '%s': %d is greater than %d", storeAs, min, max))
+	}
+	s.ask(question, storeAs, s.handleIntAnswer)
+	s.lastQuestion.validate = func(answer string) error {
+		result, err := strconv.Atoi(answer)
+		if err != nil || result < min || result > max {
+			return fmt.Errorf("Please enter an integer from %d to %d", min, max)
+		}
+		return nil
+	}
+	return s
+}
+
+// AskForBool promps the user for a yes or no answer; the answers
+// accepted are set with WithBoolAnswers. If the user's input is
+// unacceptable then they will be prompted again
+func (s *Shell) AskForBool(question, storeAs string) *Shell {
+	return s.ask(s.boolQuestion(question), storeAs, s.handleBoolAnswer)
+}
+
+// Confirm asks the user to confirm before the flow continues, accepting
+// the same answers as AskForBool. If the user declines, they are taken
+// back to the previous prompt, or the session ends with ErrDeclined if
+// there is none
+func (s *Shell) Confirm(question string) *Shell {
+	storeAs := uuid.NewString()
+	return s.askThen(s.boolQuestion(question), storeAs, s.handleBoolAnswer, func(e *list.Element) *list.Element {
+		confirmed, _ := Get[bool](s, storeAs)
+		s.answers.delete(storeAs)
+		if !confirmed {
+			return s.decline()
+		}
+		return s.nextEvent(e)
+	})
 }
 
 // GetValue is used to retrieve strings inputted by the user
-// in the function Ask
+// in the function Ask; the answers to other questions are returned
+// as the user typed them
 func (s *Shell) GetValue(storedAs string) string {
-	return s.qas[storedAs]
+	answer, _ := s.answers.Get(storedAs)
+	return answer.Raw
 }
 
 // GetIntValue is used to retrieve integers inputted by the user
 // in the function AskForInt
 func (s *Shell) GetIntValue(storedAs string) (result int, found bool) {
-	result, found = s.intQas[storedAs]
-	return
+	return Get[int](s, storedAs)
 }
 
 // GetFloatValue is used to retrieve floats inputted by the user
 // in the function AskForFloat
 func (s *Shell) GetFloatValue(storedAs string) (result float64, found bool) {
-	result, found = s.floatQas[storedAs]
+	return Get[float64](s, storedAs)
+}
+
+// GetBoolValue is used to retrieve the answers to AskForBool
+func (s *Shell) GetBoolValue(storedAs string) (result bool, found bool) {
+	return Get[bool](s, storedAs)
+}
+
+// GetValues is used to retrieve the options chosen by the user
+// in the function AskMultiChoice
+func (s *Shell) GetValues(storedAs string) (result []string, found bool) {
+	return Get[[]string](s, storedAs)
+}
+
+// GetSecret is used to retrieve the answers to AskSecret. The slice
+// returned is the shell's own copy, so zeroing it clears the answer
+func (s *Shell) GetSecret(storedAs string) (result []byte, found bool) {
+	result, found = s.secrets[storedAs]
 	return
 }
 
+// ZeroSecret overwrites the answer to AskSecret stored as storedAs
+// with zeros and forgets it
+func (s *Shell) ZeroSecret(storedAs string) {
+	secret := s.secrets[storedAs]
+	for i := range secret {
+		secret[i] = 0
+	}
+	delete(s.secrets, storedAs)
+}
+
 func (s *Shell) getFlow() *Flow {
 	if s.flow == nil {
-		s.flow = NewFlow()
+		s.flow = s.newFlow()
 		return s.flow
 	}
 	if len(s.command) < 1 {
@@ -325,9 +800,15 @@ func (s *Shell) getFlow() *Flow {
 	return s.flow.Flows[s.command]
 }
 
+func (s *Shell) newFlow() *Flow {
+	flow := NewFlow()
+	flow.WaitTime = s.waitTime
+	return flow
+}
+
 func (s *Shell) setFlow(flow *Flow, command string) {
 	if s.flow == nil {
-		s.flow = NewFlow()
+		s.flow = s.newFlow()
 	}
 	s.flow.Flows[command] = flow
 }
@@ -340,77 +821,169 @@ func (s *Shell) reservedWord(input string) {
 	}
 }
 
-func (s *Shell) ask(question, storeAs string, handler func(string) bool) *Shell {
-	s.getFlow().AddEvent(func(e *list.Element) *list.Element {
-		defer func() { s.awaitingAnswer = "" }()
-		s.awaitingAnswer = storeAs
-		if err := s.awaitAnyInput(handler, "> "+question); err != nil {
-			<-s.exit()
+func (s *Shell) askWithDefault(question, storeAs, def string, handler func(string) bool) *Shell {
+	s.ask(fmt.Sprintf("%s [%s]", question, def), storeAs, handler)
+	s.lastQuestion.def = def
+	return s
+}
+
+func (s *Shell) ask(message, storeAs string, handler func(string) bool) *Shell {
+	return s.askThen(message, storeAs, handler, s.nextEvent)
+}
+
+// askThen adds an Ask event; then returns the event that follows
+// once the question has been answered
+func (s *Shell) askThen(message, storeAs string, handler func(string) bool, then EventFunc) *Shell {
+	s.checkTemplate(message)
+	q := &question{storeAs: storeAs}
+	flow := s.getFlow()
+	flow.AddEvent(func(e *list.Element) *list.Element {
+		defer func() { s.awaitingAnswer, s.asking = "", nil }()
+		s.awaitingAnswer, s.asking = storeAs, q
+		display, ok := s.render(message)
+		if !ok {
+			return nil
 		}
-		return s.nextEvent(e)
+		display = s.prompt + display
+		if q.options != nil {
+			if !s.loadChoices(q) {
+				return nil
+			}
+			display += s.menu(q)
+		}
+		if err := s.awaitAnyInput(handler, display); err != nil {
+			return nil
+		}
+		return then(e)
 	})
+	q.event = flow.Events.Back()
+	s.lastQuestion = q
 	return s
 }
 
 func (s *Shell) newJitter(waitFor int, message string) *jitter {
-	ctx, cancel := context.WithCancel(context.Background())
+	timeout := time.Duration(waitFor) * time.Millisecond
+	ctx, cancel := context.WithTimeout(s.ctx, timeout)
+	deadline, _ := ctx.Deadline()
 	jitterEnded := make(chan struct{}, 1)
 	return &jitter{
 		ctx:         ctx,
 		cancel:      cancel,
 		jitterEnded: jitterEnded,
-		waitFor:     waitFor,
+		timeout:     timeout,
+		deadline:    deadline,
 		message:     message,
 		pos:         0,
-		count:       0,
 	}
 }
 
-func (s *Shell) runFunc(waitFor int, message string, callback ExecFunc) error {
+// runFunc runs the callback with a context that times out after waitFor
+// milliseconds; the error wraps ErrTimeout if the callback runs past it
+func (s *Shell) runFunc(waitFor int, message string, callback func(*jitter) error) error {
 	jitter := s.newJitter(waitFor, message)
 	go func() {
 		s.jitter(jitter)
 	}()
-	for {
-		select {
-		case <-jitter.ctx.Done():
-			err := jitter.ctx.Err()
-			<-jitter.jitterEnded
-			return err
-		default:
-			err := callback(jitter.ctx, jitter.cancel)
-			jitter.cancel()
-			<-jitter.jitterEnded
-			return err
-		}
+	if err := jitter.ctx.Err(); err != nil {
+		<-jitter.jitterEnded
+		return err
+	}
+	returned, err := s.call(jitter.ctx, func() error {
+		return callback(jitter)
+	})
+	jitter.cancel()
+	<-jitter.jitterEnded
+	if !returned {
+		s.waitForShellError(errorUUID, fmt.Sprintf("%s%s did not stop within %s and was abandoned", s.prompt, jitter.status(), s.gracePeriod))
+	}
+	if errors.Is(jitter.ctx.Err(), context.DeadlineExceeded) {
+		return &timeoutError{message: jitter.status(), timeout: jitter.timeout, err: err}
+	}
+	return err
+}
+
+// call returns the error of f once it returns. If a grace period is
+// configured, f is abandoned if it has not returned by the end of the
+// grace period after ctx is done, and returned is false
+func (s *Shell) call(ctx context.Context, f func() error) (returned bool, err error) {
+	if s.gracePeriod <= 0 {
+		return true, f()
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- f()
+	}()
+	select {
+	case err := <-result:
+		return true, err
+	case <-ctx.Done():
+	}
+	grace := time.NewTimer(s.gracePeriod)
+	defer grace.Stop()
+	select {
+	case err := <-result:
+		return true, err
+	case <-grace.C:
+		return false, nil
 	}
 }
 
-func (j *jitter) displayError(s *Shell) {
-	s.Display(fmt.Sprintf("> %s %s", j.message, " ...error"), true)
+func (j *jitter) displayTimedOut(s *Shell) {
+	s.Display(fmt.Sprintf("%s%s %s", s.prompt, j.status(), " ...timed out"), true)
 }
 
 func (j *jitter) displayDone(s *Shell) {
-	s.Display(fmt.Sprintf("> %s %s", j.message, " ...done"), true)
+	s.Display(fmt.Sprintf("%s%s %s", s.prompt, j.status(), " ...done"), true)
+}
+
+func (j *jitter) displayCanceled(s *Shell) {
+	s.Display(fmt.Sprintf("%s%s %s", s.prompt, j.status(), " ...cancelled"), true)
+}
+
+func (j *jitter) status() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.message
+}
+
+func (j *jitter) setStatus(message string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.message = message
+}
+
+// pause stops the spinner until resume is called; the spinner is flushed
+// so that it is cleared by what follows
+func (j *jitter) pause(s *Shell) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.paused = true
+	s.writer.Flush()
+}
+
+func (j *jitter) resume() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.paused = false
 }
 
 func (s *Shell) jitter(j *jitter) {
 	defer s.writer.Flush()
-	load := time.NewTicker(time.Millisecond * JITTER_TIME)
+	load := time.NewTicker(s.spinnerInterval)
 	defer load.Stop()
 	for {
 		select {
 		case <-load.C:
-			j.count += JITTER_TIME
-			j.pos = s.loadScreen(j.pos, j.message)
-			if j.count > j.waitFor {
-				j.cancel()
-				j.displayError(s)
-				j.jitterEnded <- struct{}{}
-				return
-			}
+			s.loadScreen(j)
 		case <-j.ctx.Done():
-			j.displayDone(s)
+			switch {
+			case errors.Is(j.ctx.Err(), context.DeadlineExceeded):
+				j.displayTimedOut(s)
+			case s.ctx.Err() != nil:
+				j.displayCanceled(s)
+			default:
+				j.displayDone(s)
+			}
 			j.jitterEnded <- struct{}{}
 			return
 		}
@@ -429,12 +1002,44 @@ func (s *Shell) greeting() {
 	for i := 0; i < longestLine; i++ {
 		line += "_"
 	}
-	fmt.Print("\t" + line + "\n\n\t" + strings.Join(msg, "\n\t") + "\n\t" + line + "\n\n")
+	fmt.Fprint(s.out, "\t"+line+"\n\n\t"+strings.Join(msg, "\n\t")+"\n\t"+line+"\n\n")
+}
+
+// fail displays err and ends the session
+func (s *Shell) fail(reason, err error) {
+	s.waitForShellError(errorUUID, s.prompt+err.Error())
+	s.end(&ExitError{Reason: reason, Err: err})
+}
+
+// end ends the session; the first error given is the one returned by Start
+func (s *Shell) end(err error) {
+	s.endOnce.Do(func() {
+		s.exitErr = err
+		close(s.cancel)
+	})
+}
+
+// watch ends the session when ctx is cancelled before the session ends
+func (s *Shell) watch(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		s.end(&ExitError{Reason: ErrCanceled, Err: ctx.Err()})
+	case <-s.cancel:
+	}
 }
 
-func (s *Shell) exit() <-chan struct{} {
-	close(s.cancel)
-	return s.quit
+// ended reports whether the session has ended; it ends as soon as the
+// context passed to Run is cancelled, whether or not watch has noticed yet
+func (s *Shell) ended() bool {
+	if err := s.ctx.Err(); err != nil {
+		s.end(&ExitError{Reason: ErrCanceled, Err: err})
+	}
+	select {
+	case <-s.cancel:
+		return true
+	default:
+		return false
+	}
 }
 
 func (s *Shell) running() {
@@ -446,8 +1051,12 @@ func (s *Shell) runEvents() {
 	e := s.flow.Events.Front()
 	for {
 		if e == nil {
-			<-s.exit()
-			return
+			if s.ended() || len(s.resume) < 1 {
+				s.end(nil)
+				return
+			}
+			e = s.resumeFlow()
+			continue
 		}
 		v := e.Value
 		if event, ok := v.(EventFunc); ok {
@@ -463,7 +1072,10 @@ func (s *Shell) handleCommand(command string) bool {
 	case errorUUID:
 		return false
 	case QUIT, EXIT:
-		<-s.exit()
+		s.end(&ExitError{Reason: ErrUserQuit})
+		return false
+	case BACK:
+		s.back()
 		return false
 	case exitUUID:
 		return true
@@ -480,60 +1092,175 @@ func (s *Shell) flowCommand(command string) bool {
 	if !ok {
 		return false
 	}
+	s.visited = append(s.visited, s.flow)
 	s.flow = flow
 	return true
 }
 
+// back returns to the flow that was visited before the current one;
+// its instruction and commands are displayed again with the next prompt
+func (s *Shell) back() {
+	if len(s.visited) < 1 {
+		s.waitForShellOutput(BACK, s.prompt+"there is nothing to go back to", false, false)
+		return
+	}
+	last := len(s.visited) - 1
+	s.flow = s.visited[last]
+	s.visited = s.visited[:last]
+	// going back to before a ThenIf or Switch leaves its rules
+	for len(s.resume) > 0 && s.resume[len(s.resume)-1].visited > len(s.visited) {
+		s.resume = s.resume[:len(s.resume)-1]
+	}
+}
+
+// enter runs the rules of c, resuming after the event e once they have run
+func (s *Shell) enter(c *conditional, e *list.Element) *list.Element {
+	if c == nil || c.build == nil {
+		return s.nextEvent(e)
+	}
+	if c.flow == nil {
+		// the rules are built on the first visit, as with ThenBranch
+		c.flow = s.buildFlow(c.build)
+	}
+	s.resume = append(s.resume, resumption{flow: s.flow, next: s.nextEvent(e), visited: len(s.visited)})
+	s.flow = c.flow
+	return s.flow.Events.Front()
+}
+
+// resumeFlow returns to the flow that entered the rules that have just run
+func (s *Shell) resumeFlow() *list.Element {
+	last := len(s.resume) - 1
+	r := s.resume[last]
+	s.resume = s.resume[:last]
+	s.flow = r.flow
+	s.visited = s.visited[:r.visited]
+	return r.next
+}
+
 func (s *Shell) handleAnswer(command string) bool {
+	return s.handleParsedAnswer(command, s.parsers[typeOf[string]()])
+}
+
+// handleTypedAnswer returns a handler that reads answers using the parser
+// registered for t
+func (s *Shell) handleTypedAnswer(t reflect.Type) func(string) bool {
+	return func(command string) bool {
+		parse, ok := s.parsers[t]
+		if !ok {
+			s.fail(ErrMisconfigured, fmt.Errorf("no parser is registered for %s", t))
+			return false
+		}
+		return s.handleParsedAnswer(command, parse)
+	}
+}
+
+// handleParsedAnswer stores the answer read by parse; if the answer is not
+// accepted by the question's validator or parse, the reason is displayed
+// and the user is prompted again
+func (s *Shell) handleParsedAnswer(command string, parse parser) bool {
 	if command == exitUUID {
 		return true
 	}
 	if len(command) < 1 {
 		return false
 	}
-	s.qas[s.awaitingAnswer] = command
-	return true
-}
-
-func (s *Shell) handleIntAnswer(command string) bool {
-	if !s.handleAnswer(command) {
-		return false
+	if s.asking != nil && s.asking.validate != nil {
+		if err := s.asking.validate(command); err != nil {
+			s.waitForShellOutput("validation", s.prompt+err.Error(), false, false)
+			return false
+		}
 	}
-	// Try convert to int 64
-	result, err := strconv.Atoi(command)
+	value, err := parse(command)
 	if err != nil {
-		s.waitForShellOutput("int_conversion", "> Please enter an integer e.g. 34", false, false)
+		s.waitForShellOutput("conversion", s.prompt+err.Error(), false, false)
 		return false
 	}
-	s.intQas[s.awaitingAnswer] = result
+	s.answers.set(s.awaitingAnswer, command, value)
 	return true
 }
 
-func (s *Shell) handleFloatAnswer(command string) bool {
-	if !s.handleAnswer(command) {
-		return false
+func (s *Shell) handleBoolAnswer(command string) bool {
+	return s.handleParsedAnswer(command, s.parsers[typeOf[bool]()])
+}
+
+func (s *Shell) parseBool(command string) (result bool, ok bool) {
+	for _, t := range s.truthy {
+		if strings.EqualFold(command, t) {
+			return true, true
+		}
 	}
-	// Try convert to int 64
-	result, err := strconv.ParseFloat(command, 64)
-	if err != nil {
-		s.waitForShellOutput("float_conversion", "> Please enter a number e.g. 3.1415", false, false)
+	for _, f := range s.falsy {
+		if strings.EqualFold(command, f) {
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// boolQuestion shows the answers to a yes or no question
+func (s *Shell) boolQuestion(question string) string {
+	return fmt.Sprintf("%s (%s/%s)", question, s.truthy[0], s.falsy[0])
+}
+
+// decline returns to the prompt of the flow visited before the current one,
+// or ends the session with ErrDeclined if there is none
+func (s *Shell) decline() *list.Element {
+	if len(s.visited) < 1 {
+		s.end(&ExitError{Reason: ErrDeclined})
+		return nil
+	}
+	s.back()
+	return s.flow.prompt
+}
+
+func (s *Shell) handleSecretAnswer(command string) bool {
+	if command == exitUUID {
+		return true
+	}
+	if len(command) < 1 {
 		return false
 	}
-	s.floatQas[s.awaitingAnswer] = result
+	s.ZeroSecret(s.awaitingAnswer)
+	s.secrets[s.awaitingAnswer] = []byte(command)
 	return true
 }
 
-func (s *Shell) runExec(f ExecFunc, loadingMessage string, timeout uint) {
-	if err := s.runFunc(int(timeout), loadingMessage, f); err != nil {
+func (s *Shell) handleIntAnswer(command string) bool {
+	return s.handleParsedAnswer(command, s.parsers[typeOf[int]()])
+}
+
+func (s *Shell) handleFloatAnswer(command string) bool {
+	return s.handleParsedAnswer(command, s.parsers[typeOf[float64]()])
+}
+
+// runResult displays the error returned by a function; ok is false if
+// the function failed fatally and the session has ended
+func (s *Shell) runResult(err error) (ok bool, _ error) {
+	if s.ended() {
+		return false, err
+	}
+	if err == nil {
+		return true, nil
+	}
+	if _, ok := err.(*timeoutError); ok {
+		s.waitForShellError(errorUUID, s.prompt+err.Error())
+	} else {
 		s.bufferError(err)
 	}
+	var fatal *fatalError
+	if errors.As(err, &fatal) {
+		s.end(&ExitError{Reason: ErrExecFailed, Err: fatal.err})
+		return false, err
+	}
+	return true, err
 }
 
 func (s *Shell) badCommand(command string) bool {
 	s.waitForShellOutput(
 		command,
 		fmt.Sprintf(
-			"> unrecognised command '%s'",
+			"%sunrecognised command '%s'",
+			s.prompt,
 			strings.ReplaceAll(command, "\n", ""),
 		),
 		false,
@@ -551,11 +1278,19 @@ func (s *Shell) capture(command *string) {
 }
 
 func (s *Shell) waitForShellOutput(input, msg string, overwrite, hidden bool) {
-	// if not in testing drain the channel
-	<-s.shellOutput(input, msg, overwrite, hidden)
+	<-s.shellOutput(s.out, input, msg, overwrite, hidden)
+}
+
+func (s *Shell) waitForShellError(input, msg string) {
+	<-s.shellOutput(s.errOut, input, msg, false, true)
 }
 
-func (s *Shell) shellOutput(input, msg string, overwrite, hidden bool) <-chan bool {
+// shellOutput records msg in the Buffer and writes it to w; a running
+// function may display messages while the spinner does, so both are
+// done under outputMu
+func (s *Shell) shellOutput(w io.Writer, input, msg string, overwrite, hidden bool) <-chan bool {
+	s.outputMu.Lock()
+	defer s.outputMu.Unlock()
 	b := &BufferObject{
 		In:     input,
 		Out:    msg,
@@ -570,45 +1305,44 @@ func (s *Shell) shellOutput(input, msg string, overwrite, hidden bool) <-chan bo
 	if overwrite {
 		fmt.Fprintln(s.writer, msg)
 	} else {
-		fmt.Println(msg)
+		fmt.Fprintln(w, msg)
 	}
 	s.shellOutChan <- true
 	return s.shellOutChan
 }
 
 func (s *Shell) bufferError(err error) {
-	switch err.Error() {
-	case "EOF":
-		return
-	case "carriage_return":
-		s.UserInput <- ""
-		return
-	default:
-		s.waitForShellOutput(errorUUID, fmt.Sprintf("> An error occured (%s)", err.Error()), false, true)
-	}
+	s.waitForShellError(errorUUID, fmt.Sprintf("%sAn error occured (%s)", s.prompt, err.Error()))
 }
 
-func (s *Shell) waitForInput() {
-	s.instruct()
-	userInput, err := s.Reader.ReadString('\n')
-	if err != nil && userInput == "\n" {
-		err = errors.New("carriage_return")
-	}
-	if err != nil {
-		s.bufferError(err)
-		return
+// prepareInput turns a line read by the input pump into a command or answer;
+// secrets are taken as they were typed and are not recorded anywhere
+func (s *Shell) prepareInput(userInput string) string {
+	if s.asking != nil && s.asking.secret {
+		return strings.TrimSuffix(strings.TrimSuffix(userInput, "\n"), "\r")
 	}
 	s.sanitize(&userInput)
 	s.capture(&userInput)
 	s.special(&userInput)
+	s.remember(userInput)
 	s.emptyUserInput(&userInput)
-	s.UserInput <- userInput
+	return userInput
 }
 
 func (s *Shell) emptyUserInput(userInput *string) {
 	*userInput = strings.TrimSuffix(*userInput, "\n")
-	if len(s.awaitingAnswer) < 1 && len(*userInput) < 1 && len(s.flow.Default) > 0 {
-		*userInput = s.flow.Default
+	if len(*userInput) > 0 {
+		return
+	}
+	def := s.flow.Default
+	if len(s.awaitingAnswer) > 0 {
+		def = ""
+		if s.asking != nil {
+			def = s.asking.def
+		}
+	}
+	if len(def) > 0 {
+		*userInput = def
 		s.waitForShellOutput(*userInput, *userInput, false, false)
 	}
 }
@@ -617,48 +1351,71 @@ func (s *Shell) emptyFlow() bool {
 	return len(s.flow.Flows) < 1
 }
 
-func (s *Shell) instruct() {
+// instruct displays the current flow's instruction and commands; it returns
+// false if the instruction could not be rendered and the session has ended
+func (s *Shell) instruct() bool {
 	if s.emptyFlow() {
-		return
+		return true
 	}
 	if len(s.awaitingAnswer) > 0 {
-		return
+		return true
 	}
-	instruction := fmt.Sprintf("> %s [options: %s]", s.flow.Instruction, strings.Join(s.flow.BaseCommands, ", "))
+	instruction, ok := s.render(s.flow.Instruction)
+	if !ok {
+		return false
+	}
+	instruction = fmt.Sprintf("%s%s [options: %s]", s.prompt, instruction, strings.Join(s.flow.BaseCommands, ", "))
 	if len(s.flow.Default) > 0 {
 		instruction = fmt.Sprintf("%s (default '%s')", instruction, s.flow.Default)
 	}
 	s.waitForShellOutput("", instruction, false, false)
+	return true
 }
 
-func (s *Shell) loadScreen(pos int, message string) int {
-	s.Display(fmt.Sprintf("> %s %s", message, disp[pos]), true)
-	if pos == 3 {
-		pos = 0
+// loadScreen displays the next frame of the spinner, or the progress of
+// the function, with the time left before it times out, unless the jitter
+// is paused. If the output is not a TTY the progress is displayed as a
+// line of its own every so often
+func (s *Shell) loadScreen(j *jitter) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.paused {
+		return
+	}
+	now := time.Now()
+	left := timeLeft(j.deadline.Sub(now))
+	switch {
+	case j.progress == nil:
+		s.Display(fmt.Sprintf("%s%s %s (%s left)", s.prompt, j.message, s.spinnerFrames[j.pos], left), true)
+	case s.outTTY:
+		s.Display(fmt.Sprintf("%s%s %s (%s left)", s.prompt, j.message, j.progress.bar(s.spinnerFrames[j.pos], now), left), true)
+	default:
+		if line, ok := j.progress.line(now); ok {
+			s.Display(fmt.Sprintf("%s%s %s (%s left)", s.prompt, j.message, line, left), false)
+		}
+	}
+	if j.pos == len(s.spinnerFrames)-1 {
+		j.pos = 0
 	} else {
-		pos++
+		j.pos++
 	}
-	time.Sleep(time.Millisecond * 140)
-	return pos
 }
 
-func getIO() (StdIn io.Writer, reader *bufio.Reader) {
-	if Testing {
-		var b []byte
-		in := bytes.NewBuffer(b)
-		reader = bufio.NewReader(in)
-		StdIn = in
-		return
+// timeLeft rounds the time left before a timeout to the second, or to
+// the tenth of a second if there are less than ten seconds left
+func timeLeft(left time.Duration) time.Duration {
+	if left < 0 {
+		return 0
 	}
-	in := os.Stdin
-	reader = bufio.NewReader(in)
-	StdIn = in
-	return
+	if left < time.Second*10 {
+		return left.Round(time.Millisecond * 100)
+	}
+	return left.Round(time.Second)
 }
 
-func getWriter() *uilive.Writer {
+func getWriter(out io.Writer) *uilive.Writer {
 	writer := uilive.New()
-	writer.Start()
+	writer.Out = out
 	return writer
 }
 
@@ -667,7 +1424,7 @@ func (s *Shell) special(userInput *string) {
 	if len(bytes) >= 3 {
 		if bytes[0] == 27 && bytes[1] == 91 {
 			if bytes[2] == 65 {
-				*userInput = s.lastCommand()
+				*userInput = s.history.last()
 				return
 			}
 			*userInput = ""
@@ -675,18 +1432,16 @@ func (s *Shell) special(userInput *string) {
 	}
 }
 
-func (s *Shell) lastCommand() string {
-	for e := s.Buffer.Front(); e != nil; e = e.Next() {
-		if e.Value != nil {
-			if add, ok := e.Value.(*BufferObject); ok {
-				if len(add.In) < 1 {
-					continue
-				}
-				return add.In
-			}
-		}
+// remember adds the user's input to the history, unless it answers a
+// sensitive question. The history file is no longer written after it fails
+func (s *Shell) remember(userInput string) {
+	if s.asking != nil && s.asking.sensitive {
+		return
+	}
+	if err := s.history.add(userInput); err != nil {
+		s.bufferError(fmt.Errorf("could not save the history: %w", err))
+		s.history.file = ""
 	}
-	return ""
 }
 
 func (s *Shell) sanitize(command *string) {
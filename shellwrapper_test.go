@@ -1,34 +1,34 @@
 package shellwrapper
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"net/url"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
-var (
-	r    *os.File
-	w    *os.File
-	outC chan string
-	old  *os.File
-)
-
-func TestMain(m *testing.M) {
-	old = os.Stdout
-	defer func() {
-		os.Stdout = old
-	}()
-	code := m.Run()
-	os.Exit(code)
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
 }
 
 func TestNew(t *testing.T) {
-	sh := NewShell()
+	sh, err := NewShell()
+	if err != nil {
+		t.Fatal(err)
+	}
 	if sh.flow == nil {
 		t.Errorf("expected non-nil flow")
 	}
@@ -46,39 +46,170 @@ func TestNew(t *testing.T) {
 	}
 }
 
+func TestOptions(t *testing.T) {
+	t.Parallel()
+	sh, in, out := newTestShell(t,
+		WithGreeting("Hello Test!"),
+		WithBufferSize(40),
+		WithPrompt("$ "),
+		WithSpinner(time.Millisecond*10, ".", "o", "O"),
+		WithWaitTime(50),
+		WithSignals(),
+	)
+	defer in.Close()
+	if sh.bufferSize != 40 {
+		t.Errorf("expected shell buffer size to be 40, got %d", sh.bufferSize)
+	}
+	if sh.flow.WaitTime != 50 {
+		t.Errorf("expected the root flow's wait time to be 50, got %d", sh.flow.WaitTime)
+	}
+	sh.FirstInstruction("run programme?").IfUserInputs("yes").
+		ThenRun(func(ctx context.Context, cf context.CancelFunc) error {
+			<-ctx.Done()
+			return fmt.Errorf("timeout (expected)")
+		}, "running...", 0)
+	done := start(sh)
+	write(t, in, "yes\n")
+	wait(t, done)
+	for _, message := range []string{"Hello Test!", "$ run programme?", "$ running... O", "$ running... timed out after 50ms (timeout (expected))"} {
+		if !strings.Contains(out.String(), message) {
+			t.Errorf("expected output to contain '%s'", message)
+		}
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	_, err := NewShell(WithBufferSize(0), WithSpinner(0), WithOutput(nil), WithBoolAnswers([]string{"yes", "ok"}, []string{"OK"}), WithGracePeriod(-time.Second))
+	if err == nil {
+		t.Fatal("expected an error for an invalid configuration")
+	}
+	for _, message := range []string{"buffer size must be at least 1", "spinner interval must be positive", "spinner must have at least one frame", "output must not be nil", "answer 'ok' cannot be both true and false", "grace period must not be negative"} {
+		if !strings.Contains(err.Error(), message) {
+			t.Errorf("expected error '%s' to contain '%s'", err.Error(), message)
+		}
+	}
+}
+
+func TestInvalidBufferSize(t *testing.T) {
+	t.Parallel()
+	sh, in, out := newTestShell(t)
+	defer in.Close()
+	sh.SetBufferSize(0).FirstInstruction("run programme?").IfUserInputs("yes").ThenQuit("thank you")
+	err := sh.Validate()
+	if err == nil || !strings.Contains(err.Error(), "start: buffer size must be at least 1, got 0") {
+		t.Fatalf("expected the buffer size to be reported, got %v", err)
+	}
+	// the size is ignored, so the buffer still works
+	sh.Display("hello", false)
+	waitForOutput(t, out, "hello")
+	if sh.Buffer.Len() != 1 {
+		t.Errorf("expected 1 item in the buffer, got %d", sh.Buffer.Len())
+	}
+}
+
+// TestNoGoroutineLeak is not parallel so that no other shells are running
+func TestNoGoroutineLeak(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	out := &syncBuffer{}
+	for i := 0; i < 3; i++ {
+		sh, err := NewShell(WithInput(r), WithOutput(out), WithErrorOutput(out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sh.FirstInstruction("run programme?").IfUserInputs("yes").ThenQuit("thank you")
+		done := start(sh)
+		waitForOutput(t, out, "run programme?")
+		sh.OsInterrupt <- os.Interrupt
+		if err := wait(t, done); !errors.Is(err, ErrInterrupted) {
+			t.Fatalf("expected the session to end with ErrInterrupted, got %v", err)
+		}
+		waitForNoShellGoroutines(t)
+	}
+	// the input is left usable by the host programme
+	go fmt.Fprint(w, "still readable\n")
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil || line != "still readable\n" {
+		t.Errorf("expected the input to be readable after the shell exited, got '%s' (%v)", line, err)
+	}
+}
+
+// TestNoGoroutineLeakBlockingFile is not parallel so that no other shells
+// are running
+func TestNoGoroutineLeakBlockingFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("reads of files are only polled on Unix")
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	defer r.Close()
+	// Fd puts the pipe into blocking mode, like a piped os.Stdin, so read
+	// deadlines do not interrupt its reads
+	r.Fd()
+	out := &syncBuffer{}
+	sh, err := NewShellWithIO(r, out, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh.FirstInstruction("run programme?").IfUserInputs("yes").ThenQuit("thank you")
+	done := start(sh)
+	waitForOutput(t, out, "run programme?")
+	sh.OsInterrupt <- os.Interrupt
+	if err := wait(t, done); !errors.Is(err, ErrInterrupted) {
+		t.Fatalf("expected the session to end with ErrInterrupted, got %v", err)
+	}
+	waitForNoShellGoroutines(t)
+	go fmt.Fprint(w, "still readable\n")
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil || line != "still readable\n" {
+		t.Errorf("expected the input to be readable after the shell exited, got '%s' (%v)", line, err)
+	}
+}
+
 func TestBadCommand(t *testing.T) {
-	Testing = true
-	sh := NewShell()
+	t.Parallel()
+	sh, in, _ := newTestShell(t)
+	defer in.Close()
 	sh.FirstInstruction("run programme?").IfUserInputs("yes", "y", "Yes", "YES", "Y").Default("yes").ThenQuit("thank you")
-	go sh.Start()
-	bufferOutput()
-	write(sh, "bad_command\n")
-	getOutput()
+	done := start(sh)
+	write(t, in, "bad_command\n")
+	write(t, in, "exit\n")
+	wait(t, done)
 	if err := checkShellBuffer(sh, []string{"unrecognised command 'bad_command'"}, false); err != nil {
 		t.Error(err)
 	}
 }
 
 func TestQuit(t *testing.T) {
-	Testing = true
-	sh := NewShell()
+	t.Parallel()
+	sh, in, _ := newTestShell(t)
+	defer in.Close()
 	sh.
 		FirstInstruction("run programme?").
 		IfUserInputs("yes", "y", "Yes", "YES", "Y").
 		Default("yes").
 		ThenQuit("thank you")
-	go sh.Start()
-	bufferOutput()
-	write(sh, "exit\n")
-	getOutput()
+	done := start(sh)
+	write(t, in, "exit\n")
+	if err := wait(t, done); !errors.Is(err, ErrUserQuit) {
+		t.Errorf("expected the session to end with ErrUserQuit, got %v", err)
+	}
 	if err := checkShellBuffer(sh, []string{"exiting..."}, false); err != nil {
 		t.Error(err)
 	}
 }
 
 func TestBranching(t *testing.T) {
-	Testing = true
-	sh := NewShell()
+	t.Parallel()
+	sh, in, _ := newTestShell(t)
+	defer in.Close()
 	sh.
 		FirstInstruction("run programme?").
 		SetBufferSize(1000).
@@ -93,52 +224,215 @@ func TestBranching(t *testing.T) {
 				Default("yes").
 				IfUserInputs("no").ThenQuit("OK")
 		})
-	go sh.Start()
-	bufferOutput()
-	write(sh, "n\n")
-	write(sh, "yes\n")
-	getOutput()
+	done := start(sh)
+	write(t, in, "n\n")
+	write(t, in, "yes\n")
+	wait(t, done)
 	if err := checkShellBuffer(sh, []string{"that's all we can do though.", "exiting..."}, false); err != nil {
 		t.Error(err)
 	}
 }
 
 func TestGotos(t *testing.T) {
-	Testing = true
-	sh := NewShell()
+	t.Parallel()
+	sh, in, _ := newTestShell(t)
+	defer in.Close()
 	sh.FirstInstruction("run programme?").Branch("branch_one", func() {
 		sh.IfUserInputs("hello world!").ThenQuit("hello")
 	}).Branch("branch_two", func() {
 		sh.IfUserInputs("goodbye").ThenQuit("goodbye")
 	}).IfUserInputs("one").Default("one").GoTo("branch_one", "you've entered branch one").
 		IfUserInputs("branch_two").GoTo("branch_two", "you've entered branch two")
-	go sh.Start()
-	bufferOutput()
-	write(sh, "one\n")
-	write(sh, "hello world!\n")
-	getOutput()
+	done := start(sh)
+	write(t, in, "one\n")
+	write(t, in, "hello world!\n")
+	wait(t, done)
 	if err := checkShellBuffer(sh, []string{"you've entered branch one", "hello"}, false); err != nil {
 		t.Error(err)
 	}
 }
 
+func TestBack(t *testing.T) {
+	t.Parallel()
+	sh, in, _ := newTestShell(t)
+	defer in.Close()
+	sh.
+		FirstInstruction("run programme?").
+		SetBufferSize(1000).
+		IfUserInputs("yes", "y").
+		ThenQuit("thank you").
+		IfUserInputs("no", "n").
+		ThenBranch("would you like to do anything else?", func() {
+			sh.
+				IfUserInputs("yes").
+				ThenQuit("that's all we can do though.").
+				IfUserInputs("no").ThenQuit("OK")
+		})
+	root := sh.flow
+	done := start(sh)
+	write(t, in, "n\n")
+	write(t, in, "back\n")
+	write(t, in, "n\n")
+	write(t, in, "back\n")
+	write(t, in, "y\n")
+	wait(t, done)
+	if err := checkShellBuffer(sh, []string{"thank you", "exiting..."}, false); err != nil {
+		t.Error(err)
+	}
+	if count := countShellBuffer(sh, "run programme?"); count != 3 {
+		t.Errorf("expected the first instruction to be displayed 3 times, got %d", count)
+	}
+	if commands := root.Flows["no"].BaseCommands; len(commands) != 2 {
+		t.Errorf("expected the branch to keep 2 commands after being re-entered, got %d", len(commands))
+	}
+}
+
+func TestBackGoTos(t *testing.T) {
+	t.Parallel()
+	sh, in, _ := newTestShell(t)
+	defer in.Close()
+	sh.SetBufferSize(1000).FirstInstruction("run programme?").Branch("branch_one", func() {
+		sh.IfUserInputs("hello world!").ThenQuit("hello")
+	}).Branch("branch_two", func() {
+		sh.IfUserInputs("goodbye").ThenQuit("goodbye")
+	}).IfUserInputs("one").GoTo("branch_one", "you've entered branch one").
+		IfUserInputs("two").GoTo("branch_two", "you've entered branch two")
+	done := start(sh)
+	write(t, in, "back\n")
+	write(t, in, "one\n")
+	write(t, in, "back\n")
+	write(t, in, "two\n")
+	write(t, in, "goodbye\n")
+	wait(t, done)
+	if err := checkShellBuffer(sh, []string{
+		"nothing to go back to",
+		"you've entered branch one",
+		"you've entered branch two",
+		"goodbye",
+	}, false); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestNoBranch(t *testing.T) {
-	Testing = true
-	sh := NewShell()
+	t.Parallel()
+	sh, in, _ := newTestShell(t)
+	defer in.Close()
 	sh.FirstInstruction("run programme?").IfUserInputs("one").Default("one").GoTo("branch_one", "you've entered branch one").
 		IfUserInputs("branch_two").GoTo("branch_two", "you've entered branch two")
-	go sh.Start()
-	bufferOutput()
-	write(sh, "one\n")
-	getOutput()
-	if err := checkShellBuffer(sh, []string{"branch 'branch_one' not found"}, false); err != nil {
+	// the flow is validated before the shell starts, so no input is read
+	if err := wait(t, start(sh)); !errors.Is(err, ErrMisconfigured) {
+		t.Errorf("expected the session to end with ErrMisconfigured, got %v", err)
+	}
+	if err := checkShellBuffer(sh, []string{"branch 'branch_one' not found", "branch 'branch_two' not found"}, false); err != nil {
 		t.Error(err)
 	}
 }
 
+func TestValidate(t *testing.T) {
+	t.Parallel()
+	sh, in, _ := newTestShell(t)
+	defer in.Close()
+	sh.FirstInstruction("run programme?").
+		IfUserInputs("yes", "y").
+		ThenBranch("which version?", func() {
+			sh.IfUserInputs("1").ThenQuit("installed version 1").
+				IfUserInputs("2").
+				Default("3")
+		}).
+		IfUserInputs("no", "y").GoTo("goodbye", "are you sure?").
+		IfUserInputs("maybe").GoTo("missing", "let's see").
+		Branch("goodbye", func() {
+			sh.IfUserInputs("yes").Sensitive().ThenQuit("goodbye").
+				IfUserInputs("no").GoTo("goodbye", "are you sure?")
+		}).
+		Branch("unused", func() {
+			sh.IfUserInputs("ok").ThenQuit("ok")
+		})
+	err := sh.Validate()
+	if err == nil {
+		t.Fatal("expected the flow to be invalid")
+	}
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("expected a *ValidationError, got %T", err)
+	}
+	expects := []string{
+		"start: duplicate command 'y'",
+		"start > maybe: branch 'missing' not found",
+		"start > yes: default '3' matches no command",
+		"start > yes: command '2' is a dead end (nothing happens after it)",
+		"branch 'goodbye' > yes: Sensitive must directly follow an Ask",
+		"branch 'unused' is never visited",
+	}
+	if len(validationErr.Problems) != len(expects) {
+		t.Errorf("expected %d problems, got %d: %v", len(expects), len(validationErr.Problems), err)
+	}
+	for _, expect := range expects {
+		if !strings.Contains(err.Error(), expect) {
+			t.Errorf("expected '%s' to be reported, got %v", expect, err)
+		}
+	}
+	// validating builds branches on the side, leaving the flow as it was
+	if len(sh.flow.Flows) != 4 || sh.flow.Flows["yes"].Events.Len() != 1 {
+		t.Errorf("expected validation not to change the flow")
+	}
+}
+
+func TestValidateRulesFromSameFunction(t *testing.T) {
+	t.Parallel()
+	sh, in, _ := newTestShell(t)
+	defer in.Close()
+	menu := func(next string) FlowFunc {
+		return func() {
+			sh.IfUserInputs("next").GoTo(next, "going to "+next)
+		}
+	}
+	var again FlowFunc
+	again = func() {
+		sh.IfUserInputs("again").ThenBranch("again?", again)
+	}
+	sh.FirstInstruction("run programme?").
+		IfUserInputs("one").ThenBranch("one?", menu("done")).
+		IfUserInputs("two").ThenBranch("two?", menu("missing")).
+		IfUserInputs("three").ThenBranch("three?", again).
+		Branch("done", func() {
+			sh.IfUserInputs("ok").ThenQuit("ok")
+		})
+	err := sh.Validate()
+	if err == nil || !strings.Contains(err.Error(), "start > two > next: branch 'missing' not found") {
+		t.Fatalf("expected each closure of the same function to be validated, got %v", err)
+	}
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) && len(validationErr.Problems) != 1 {
+		t.Errorf("expected 1 problem, got %v", err)
+	}
+}
+
+func TestValidateBranchOrder(t *testing.T) {
+	t.Parallel()
+	sh, in, _ := newTestShell(t)
+	defer in.Close()
+	sh.FirstInstruction("run programme?").
+		IfUserInputs("one").GoTo("branch_one", "you've entered branch one").
+		Branch("branch_one", func() {
+			sh.IfUserInputs("hello world!").ThenQuit("hello")
+		})
+	if err := sh.Validate(); err != nil {
+		t.Errorf("expected a branch set up after its GoTo to be valid, got %v", err)
+	}
+	done := start(sh)
+	write(t, in, "one\n")
+	write(t, in, "hello world!\n")
+	if err := wait(t, done); err != nil {
+		t.Errorf("expected the session to end without an error, got %v", err)
+	}
+}
+
 func TestFunc(t *testing.T) {
-	Testing = true
-	sh := NewShell()
+	t.Parallel()
+	sh, in, _ := newTestShell(t)
+	defer in.Close()
 	var message string
 	sh.SetGreeting("welcome to the test shell").
 		SetBufferSize(10000).
@@ -153,10 +447,9 @@ func TestFunc(t *testing.T) {
 			}
 		}
 	}, "function loading", 10000).ThenQuit("thank you")
-	go sh.Start()
-	bufferOutput()
-	write(sh, "\n")
-	getOutput()
+	done := start(sh)
+	write(t, in, "\n")
+	wait(t, done)
 	if message != "ran function" {
 		t.Errorf("expected message from function to be 'ran function', got '%s'", message)
 	}
@@ -165,8 +458,9 @@ func TestFunc(t *testing.T) {
 // One might see some weird terminal artifacts with this function
 // This is when the goroutine for the function is run
 func TestFuncTimeout(t *testing.T) {
-	Testing = true
-	sh := NewShell()
+	t.Parallel()
+	sh, in, _ := newTestShell(t)
+	defer in.Close()
 	var message string
 	sh.SetGreeting("welcome to the test shell").
 		FirstInstruction("run programme?").IfUserInputs("yes", "y", "Yes", "YES", "Y").Default("yes").
@@ -182,11 +476,9 @@ func TestFuncTimeout(t *testing.T) {
 				}
 			}
 		}, "running...", 100).ThenQuit("thank you")
-	go sh.Start()
-	bufferOutput()
-	write(sh, string([]byte{27, 91, 65})+"\n")
-	time.Sleep(time.Second * 2) // should have timed out after three seconds
-	getOutput()
+	done := start(sh)
+	write(t, in, string([]byte{27, 91, 65})+"\n")
+	wait(t, done)
 	if len(message) > 0 {
 		t.Errorf("expected message from function to be blank (expected timeout), got '%s'", message)
 	}
@@ -195,9 +487,617 @@ func TestFuncTimeout(t *testing.T) {
 	}
 }
 
+func TestTimeout(t *testing.T) {
+	t.Parallel()
+	sh, in, out := newTestShell(t, WithSpinner(time.Millisecond*10, "."), WithGracePeriod(time.Millisecond*50))
+	defer in.Close()
+	stuck := make(chan struct{})
+	defer close(stuck)
+	var elapsed time.Duration
+	sh.ThenRun(func(ctx context.Context, cf context.CancelFunc) error {
+		started := time.Now()
+		<-ctx.Done()
+		elapsed = time.Since(started)
+		return nil
+	}, "waiting...", 300).
+		ThenRun(func(ctx context.Context, cf context.CancelFunc) error {
+			<-stuck
+			return nil
+		}, "stuck...", 100).
+		OnError(func() {
+			sh.ThenDisplay(func() string { return "recovered" })
+		})
+	done := start(sh)
+	if err := wait(t, done); err != nil {
+		t.Errorf("expected the session to end without an error, got %v", err)
+	}
+	if elapsed < time.Millisecond*300 || elapsed > time.Millisecond*450 {
+		t.Errorf("expected the function to time out after 300ms, got %s", elapsed)
+	}
+	for _, message := range []string{"> waiting... . (200ms left)", "> waiting...  ...timed out", "> waiting... timed out after 300ms", "> stuck... did not stop within 50ms and was abandoned", "> stuck... timed out after 100ms", "> recovered"} {
+		if !strings.Contains(out.String(), message) {
+			t.Errorf("expected output to contain '%s', got '%s'", message, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "An error occured") {
+		t.Errorf("expected timeouts to be displayed apart from other errors")
+	}
+	err := error(&timeoutError{message: "stuck...", timeout: time.Second, err: context.DeadlineExceeded})
+	if !errors.Is(err, ErrTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the error to match both ErrTimeout and the function's error")
+	}
+}
+
+func TestOnError(t *testing.T) {
+	t.Parallel()
+	sh, in, out := newTestShell(t)
+	defer in.Close()
+	healthy := func(ctx context.Context, cf context.CancelFunc) error {
+		return errors.New("database unreachable")
+	}
+	sh.ThenRun(healthy, "checking health...", 100).
+		OnError(func() {
+			sh.FirstInstruction("the health check failed").
+				IfUserInputs("restart").ThenDisplay(func() string { return "restarted the database" }).
+				IfUserInputs("ignore").ThenDisplay(func() string { return "ignored" })
+		}).
+		OnSuccess(func() {
+			sh.ThenDisplay(func() string { return "healthy" })
+		}).
+		ThenRun(func(ctx context.Context, cf context.CancelFunc) error {
+			sh.Answers().Set("version", 3)
+			return nil
+		}, "checking version...", 100).
+		OnSuccess(func() {
+			sh.ThenQuit("running version {{.version}}")
+		}).
+		ThenQuit("not reached")
+	done := start(sh)
+	waitForOutput(t, out, "the health check failed")
+	write(t, in, "restart\n")
+	if err := wait(t, done); err != nil {
+		t.Errorf("expected the session to end without an error, got %v", err)
+	}
+	for _, message := range []string{"> restarted the database", "> running version 3"} {
+		if !strings.Contains(out.String(), message) {
+			t.Errorf("expected output to contain '%s', got '%s'", message, out.String())
+		}
+	}
+	for _, message := range []string{"healthy", "ignored", "not reached"} {
+		if strings.Contains(out.String(), message) {
+			t.Errorf("expected output not to contain '%s'", message)
+		}
+	}
+	if version, found := Get[int](sh, "version"); !found || version != 3 {
+		t.Errorf("expected the version stored by the function to be 3, got %d (found: %v)", version, found)
+	}
+}
+
+func TestRunWithSession(t *testing.T) {
+	t.Parallel()
+	sh, in, out := newTestShell(t, WithSpinner(time.Millisecond*10, "."))
+	defer in.Close()
+	sh.Ask("what is your name?", "name").
+		ThenRunWithSession(func(sess *Session) error {
+			name, _ := sess.Answers().Get("name")
+			sess.Status("greeting " + name.Raw)
+			sess.Printf("hello %s", name.Raw)
+			sess.Logger().Info("greeted", "name", name.Raw)
+			fmt.Fprint(sess.Writer(), "first line\nsecond ")
+			fmt.Fprint(sess.Writer(), "line")
+			colour, err := sess.Ask("what is your favourite colour, {{.name}}?", "colour")
+			if err != nil {
+				return err
+			}
+			sess.Answers().Set("greeting", "hello "+name.Raw+" in "+colour)
+			return sess.Context().Err()
+		}, "working...", 5000).
+		ThenQuit("{{.greeting}}")
+	done := start(sh)
+	write(t, in, "bob\n")
+	waitForOutput(t, out, "> what is your favourite colour, bob?")
+	write(t, in, "blue\n")
+	if err := wait(t, done); err != nil {
+		t.Errorf("expected the session to end without an error, got %v", err)
+	}
+	for _, message := range []string{"> hello bob\n", "> level=INFO msg=greeted name=bob\n", "> first line\n", "> second line\n", "> greeting bob  ...done", "> hello bob in blue"} {
+		if !strings.Contains(out.String(), message) {
+			t.Errorf("expected output to contain '%s', got '%s'", message, out.String())
+		}
+	}
+	if colour, _ := sh.Answers().Get("colour"); colour.Raw != "blue" {
+		t.Errorf("expected the answer to the follow-up question to be 'blue', got '%s'", colour.Raw)
+	}
+}
+
+func TestSessionAskTimeout(t *testing.T) {
+	t.Parallel()
+	sh, in, out := newTestShell(t)
+	defer in.Close()
+	asked := make(chan error, 1)
+	sh.ThenRunWithSession(func(sess *Session) error {
+		_, err := sess.Ask("what is your favourite colour?", "colour")
+		asked <- err
+		return err
+	}, "working...", 200).
+		Ask("what is your name?", "name")
+	done := start(sh)
+	select {
+	case err := <-asked:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected Ask to return context.DeadlineExceeded, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected Ask to return once the function timed out")
+	}
+	waitForOutput(t, out, "> what is your name?")
+	// the next prompt reads a line of its own
+	write(t, in, "bob\n")
+	if err := wait(t, done); err != nil {
+		t.Errorf("expected the session to end without an error, got %v", err)
+	}
+	if name := sh.GetValue("name"); name != "bob" {
+		t.Errorf("expected the name to be 'bob', got '%s'", name)
+	}
+	if _, ok := sh.Answers().Get("colour"); ok {
+		t.Errorf("expected the abandoned question not to be answered")
+	}
+	if !strings.Contains(out.String(), "working... timed out after 200ms") {
+		t.Errorf("expected the function to time out, got '%s'", out.String())
+	}
+}
+
+func TestAbandonInput(t *testing.T) {
+	t.Parallel()
+	sh, in, _ := newTestShell(t)
+	defer in.Close()
+	go sh.pumpInput()
+	defer sh.stopInput()
+	defer sh.end(nil)
+	sh.requestInput(inputRequest{})
+	write(t, in, "blue\n")
+	// the write returns once the line has been read; the pump is given
+	// time to take it from the reader
+	time.Sleep(time.Millisecond * 50)
+	sh.abandonInput()
+	sh.requestInput(inputRequest{hidden: true})
+	write(t, in, "bob\n")
+	select {
+	case input := <-sh.UserInput:
+		if input != "bob\n" {
+			t.Errorf("expected the line typed for the abandoned prompt to be discarded, got '%s'", input)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for input")
+	}
+}
+
+func TestSessionLogger(t *testing.T) {
+	t.Parallel()
+	logs := &syncBuffer{}
+	sh, in, out := newTestShell(t, WithLogger(slog.New(slog.NewJSONHandler(logs, nil))))
+	defer in.Close()
+	sh.ThenRunWithSession(func(sess *Session) error {
+		sess.Logger().Warn("disk almost full", "free", "2%")
+		return nil
+	}, "checking disk...", 100)
+	done := start(sh)
+	wait(t, done)
+	if !strings.Contains(logs.String(), `"msg":"disk almost full","free":"2%"`) {
+		t.Errorf("expected the record to be logged by the configured logger, got '%s'", logs.String())
+	}
+	if strings.Contains(out.String(), "disk almost full") {
+		t.Errorf("expected the record not to be displayed")
+	}
+}
+
+func TestRunWithProgress(t *testing.T) {
+	t.Parallel()
+	sh, in, out := newTestShell(t, WithSpinner(time.Millisecond*10, "."))
+	defer in.Close()
+	sh.ThenRunWithProgress(func(ctx context.Context, p *Progress) error {
+		p.SetTotal(4)
+		p.Add(2)
+		// the output is not a TTY, so the progress is displayed as a line
+		for !strings.Contains(out.String(), "> copying files... 50% 2/4") {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Millisecond * 10):
+			}
+		}
+		p.SetMessage("copied files")
+		p.Add(2)
+		return nil
+	}, "copying files...", 2000)
+	done := start(sh)
+	if err := wait(t, done); err != nil {
+		t.Errorf("expected the session to end without an error, got %v", err)
+	}
+	if !strings.Contains(out.String(), "> copied files  ...done") {
+		t.Errorf("expected output to contain '> copied files  ...done', got '%s'", out.String())
+	}
+}
+
+func TestProgressBar(t *testing.T) {
+	now := time.Now()
+	p := &Progress{started: now.Add(-time.Second * 10), reported: -1}
+	if bar := p.bar("/", now); bar != "/ 0" {
+		t.Errorf("expected the progress without a total to be '/ 0', got '%s'", bar)
+	}
+	p.Add(50)
+	if bar := p.bar("/", now); bar != "/ 50 5.0/s" {
+		t.Errorf("expected the progress without a total to be '/ 50 5.0/s', got '%s'", bar)
+	}
+	p.SetTotal(200)
+	if bar := p.bar("/", now); bar != "[#####---------------] 25% 50/200 5.0/s ETA 30s" {
+		t.Errorf("expected the progress bar to be '[#####---------------] 25%% 50/200 5.0/s ETA 30s', got '%s'", bar)
+	}
+	p.Add(150)
+	if bar := p.bar("/", now); bar != "[####################] 100% 200/200 20.0/s" {
+		t.Errorf("expected the progress bar to be full, got '%s'", bar)
+	}
+	if line, ok := p.line(now); !ok || line != "100% 200/200 20.0/s" {
+		t.Errorf("expected the progress line to be '100%% 200/200 20.0/s', got '%s' (ok: %v)", line, ok)
+	}
+	p.Add(1)
+	if _, ok := p.line(now.Add(progressLineInterval / 2)); ok {
+		t.Errorf("expected no progress line so soon after the last")
+	}
+}
+
+func TestRunParallel(t *testing.T) {
+	t.Parallel()
+	sh, in, out := newTestShell(t, WithSpinner(time.Millisecond*10, "."))
+	defer in.Close()
+	var running, most atomic.Int32
+	track := func(f ExecFunc) ExecFunc {
+		return func(ctx context.Context, cf context.CancelFunc) error {
+			n := running.Add(1)
+			defer running.Add(-1)
+			for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+			}
+			time.Sleep(time.Millisecond * 20)
+			return f(ctx, cf)
+		}
+	}
+	sh.ThenRunParallel(map[string]ExecFunc{
+		"build": track(func(ctx context.Context, cf context.CancelFunc) error { return nil }),
+		"lint":  track(func(ctx context.Context, cf context.CancelFunc) error { return errors.New("lint broke") }),
+		"test": track(func(ctx context.Context, cf context.CancelFunc) error {
+			<-ctx.Done()
+			return nil
+		}),
+	}, 100, 2).
+		OnError(func() {
+			sh.ThenDisplay(func() string { return "some tasks failed" })
+		})
+	done := start(sh)
+	if err := wait(t, done); err != nil {
+		t.Errorf("expected the session to end without an error, got %v", err)
+	}
+	for _, message := range []string{"> build  ...done\n> lint  ...error (lint broke)\n> test  ...timed out", "> An error occured (lint: lint broke; test: timed out after 100ms)", "> some tasks failed"} {
+		if !strings.Contains(out.String(), message) {
+			t.Errorf("expected output to contain '%s', got '%s'", message, out.String())
+		}
+	}
+	if most.Load() > 2 {
+		t.Errorf("expected at most 2 tasks to run at once, got %d", most.Load())
+	}
+}
+
+func TestRunParallelFailFast(t *testing.T) {
+	t.Parallel()
+	sh, in, out := newTestShell(t, WithSpinner(time.Millisecond*10, "."))
+	defer in.Close()
+	sh.ThenRunParallel(map[string]ExecFunc{
+		"fail": func(ctx context.Context, cf context.CancelFunc) error {
+			return errors.New("failed")
+		},
+		"slow": func(ctx context.Context, cf context.CancelFunc) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}, 5000, 0).
+		FailFast().
+		ThenRun(func(ctx context.Context, cf context.CancelFunc) error {
+			return nil
+		}, "carrying on...", 100)
+	done := start(sh)
+	if err := wait(t, done); err != nil {
+		t.Errorf("expected the session to end without an error, got %v", err)
+	}
+	for _, message := range []string{"> fail  ...error (failed)\n> slow  ...cancelled", "> An error occured (fail: failed)", "> carrying on...  ...done"} {
+		if !strings.Contains(out.String(), message) {
+			t.Errorf("expected output to contain '%s', got '%s'", message, out.String())
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	t.Parallel()
+	sh, in, out := newTestShell(t, WithSpinner(time.Millisecond*10, "."))
+	defer in.Close()
+	var attempts, permanent int
+	sh.ThenRun(func(ctx context.Context, cf context.CancelFunc) error {
+		if attempts++; attempts < 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	}, "connecting", 1000).
+		Retry(RetryPolicy{MaxAttempts: 3, Delay: time.Millisecond * 10}).
+		ThenRun(func(ctx context.Context, cf context.CancelFunc) error {
+			permanent++
+			return errors.New("bad credentials")
+		}, "logging in", 1000).
+		Retry(RetryPolicy{MaxAttempts: 5, Retryable: func(err error) bool {
+			return err.Error() != "bad credentials"
+		}})
+	done := start(sh)
+	if err := wait(t, done); err != nil {
+		t.Errorf("expected the session to end without an error, got %v", err)
+	}
+	if attempts != 3 || permanent != 1 {
+		t.Errorf("expected 3 attempts to connect and 1 to log in, got %d and %d", attempts, permanent)
+	}
+	for _, message := range []string{"> retrying in 10ms (attempt 2 of 3)", "> connecting (attempt 3 of 3)  ...done", "> logging in (attempt 1 of 5)  ...done"} {
+		if !strings.Contains(out.String(), message) {
+			t.Errorf("expected output to contain '%s', got '%s'", message, out.String())
+		}
+	}
+	if countShellBuffer(sh, "An error occured (connection refused)") != 2 {
+		t.Errorf("expected the error of each failed attempt to be displayed")
+	}
+}
+
+func TestRetryPrompt(t *testing.T) {
+	t.Parallel()
+	sh, in, out := newTestShell(t)
+	defer in.Close()
+	var attempts int
+	fail := func(ctx context.Context, cf context.CancelFunc) error {
+		attempts++
+		return errors.New("disk full")
+	}
+	sh.ThenRun(fail, "saving", 1000).
+		Retry(RetryPolicy{MaxAttempts: 1, Prompt: true}).
+		OnError(func() {
+			sh.ThenDisplay(func() string { return "skipped saving" })
+		}).
+		ThenRun(fail, "saving again", 1000).
+		Retry(RetryPolicy{MaxAttempts: 1, Prompt: true}).
+		ThenQuit("not reached")
+	done := start(sh)
+	waitForOutput(t, out, "> retry, skip or abort?\n  1) retry\n  2) skip\n  3) abort")
+	write(t, in, "1\n")
+	write(t, in, "skip\n")
+	waitForOutput(t, out, "> skipped saving")
+	write(t, in, "abort\n")
+	err := wait(t, done)
+	if !errors.Is(err, ErrExecFailed) || err.Error() != "function failed: disk full" {
+		t.Errorf("expected aborting to end the session with ErrExecFailed, got %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+	if strings.Contains(out.String(), "not reached") {
+		t.Errorf("expected the flow to end when the user aborts")
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	r := &RetryPolicy{Delay: time.Second, Exponential: true, MaxDelay: time.Second * 5}
+	for n, expect := range map[int]time.Duration{1: time.Second, 2: time.Second * 2, 3: time.Second * 4, 4: time.Second * 5, 10: time.Second * 5} {
+		if delay := r.delay(n); delay != expect {
+			t.Errorf("expected the delay after attempt %d to be %s, got %s", n, expect, delay)
+		}
+	}
+	r = &RetryPolicy{Delay: time.Second, Exponential: true, Jitter: 1}
+	for _, n := range []int{35, 64, 1000} {
+		if delay := r.delay(n); delay < 0 {
+			t.Errorf("expected the delay after attempt %d not to overflow, got %s", n, delay)
+		}
+	}
+	r = &RetryPolicy{Delay: time.Second, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		if delay := r.delay(1); delay < time.Millisecond*500 || delay > time.Millisecond*1500 {
+			t.Fatalf("expected the delay to be within 50%% of 1s, got %s", delay)
+		}
+	}
+}
+
+func TestExec(t *testing.T) {
+	t.Parallel()
+	sh, in, out := newTestShell(t, WithSpinner(time.Millisecond*10, "."))
+	defer in.Close()
+	sh.Ask("what is your name?", "name").
+		ThenExec("sh", "-c", "echo hello $0; echo oops >&2", "{{.name}}").
+		ThenExec("sh", "-c", "echo quiet").
+		HideOutput().
+		ThenExec("sh", "-c", "echo loud; exit 3").
+		HideOutput().
+		OnError(func() {
+			sh.ThenDisplay(func() string {
+				code, _ := Get[int](sh, ExitCodeKey)
+				return fmt.Sprintf("the command exited with %d", code)
+			})
+		})
+	done := start(sh)
+	write(t, in, "bob\n")
+	if err := wait(t, done); err != nil {
+		t.Errorf("expected the session to end without an error, got %v", err)
+	}
+	for _, message := range []string{"> hello bob\n", "> oops\n", "> sh -c echo hello $0; echo oops >&2 bob  ...done", "> loud\n", "> An error occured (exit status 3)", "> the command exited with 3"} {
+		if !strings.Contains(out.String(), message) {
+			t.Errorf("expected output to contain '%s', got '%s'", message, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "> quiet") {
+		t.Errorf("expected the output of a command that succeeds to be hidden")
+	}
+	if err := checkShellBuffer(sh, []string{"> hello bob", "> loud"}, false); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExecTimeout(t *testing.T) {
+	t.Parallel()
+	sh, in, out := newTestShell(t, WithSpinner(time.Millisecond*10, "."), WithWaitTime(200))
+	defer in.Close()
+	// the sleep holds the output open, so the command only returns in time
+	// if the sleep is killed along with the shell that started it
+	sh.ThenExec("sh", "-c", "sleep 10 & wait")
+	started := time.Now()
+	done := start(sh)
+	if err := wait(t, done); err != nil {
+		t.Errorf("expected the session to end without an error, got %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second*5 {
+		t.Errorf("expected the command to be killed after 200ms, took %s", elapsed)
+	}
+	if !strings.Contains(out.String(), "> sh -c sleep 10 & wait timed out after 200ms") {
+		t.Errorf("expected the timeout to be displayed, got '%s'", out.String())
+	}
+	if code, _ := Get[int](sh, ExitCodeKey); code != -1 {
+		t.Errorf("expected the exit code of a killed command to be -1, got %d", code)
+	}
+}
+
+func TestExecWithTimeout(t *testing.T) {
+	t.Parallel()
+	sh, in, out := newTestShell(t, WithSpinner(time.Millisecond*10, "."), WithWaitTime(100))
+	defer in.Close()
+	sh.ThenExec("sh", "-c", "sleep 0.5").
+		Timeout(5000)
+	if err := wait(t, start(sh)); err != nil {
+		t.Errorf("expected the session to end without an error, got %v", err)
+	}
+	if !strings.Contains(out.String(), "> sh -c sleep 0.5  ...done") {
+		t.Errorf("expected the command to be given its own timeout, got '%s'", out.String())
+	}
+	if code, _ := Get[int](sh, ExitCodeKey); code != 0 {
+		t.Errorf("expected the exit code to be 0, got %d", code)
+	}
+}
+
+func TestErrorOutput(t *testing.T) {
+	t.Parallel()
+	in, w := io.Pipe()
+	defer w.Close()
+	out, errOut := &syncBuffer{}, &syncBuffer{}
+	sh, err := NewShellWithIO(in, out, errOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh.SetGreeting("welcome to the test shell").
+		ThenRun(func(ctx context.Context, cf context.CancelFunc) error {
+			return fmt.Errorf("something went wrong")
+		}, "running...", 1000)
+	wait(t, start(sh))
+	if !strings.Contains(out.String(), "welcome to the test shell") {
+		t.Errorf("expected the greeting to be written to the output, got '%s'", out.String())
+	}
+	if strings.Contains(out.String(), "something went wrong") {
+		t.Errorf("expected the error not to be written to the output")
+	}
+	if !strings.Contains(errOut.String(), "An error occured (something went wrong)") {
+		t.Errorf("expected the error to be written to the error output, got '%s'", errOut.String())
+	}
+}
+
+func TestFatal(t *testing.T) {
+	t.Parallel()
+	sh, in, _ := newTestShell(t)
+	defer in.Close()
+	var displayed bool
+	sh.ThenRun(func(ctx context.Context, cf context.CancelFunc) error {
+		return Fatal(fmt.Errorf("could not connect"))
+	}, "connecting...", 1000).ThenDisplay(func() string {
+		displayed = true
+		return "connected"
+	})
+	err := wait(t, start(sh))
+	if !errors.Is(err, ErrExecFailed) {
+		t.Errorf("expected the session to end with ErrExecFailed, got %v", err)
+	}
+	if err == nil || err.Error() != "function failed: could not connect" {
+		t.Errorf("expected the error to describe the cause, got %v", err)
+	}
+	if displayed {
+		t.Errorf("expected the flow to stop after a fatal error")
+	}
+}
+
+func TestInputClosed(t *testing.T) {
+	t.Parallel()
+	sh, in, _ := newTestShell(t)
+	sh.FirstInstruction("run programme?").IfUserInputs("yes").ThenQuit("thank you")
+	done := start(sh)
+	in.Close()
+	if err := wait(t, done); !errors.Is(err, ErrInputClosed) {
+		t.Errorf("expected the session to end with ErrInputClosed, got %v", err)
+	}
+}
+
+func TestRunCanceled(t *testing.T) {
+	t.Parallel()
+	sh, in, out := newTestShell(t)
+	defer in.Close()
+	sh.FirstInstruction("run programme?").IfUserInputs("yes").ThenQuit("thank you")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- sh.Run(ctx)
+	}()
+	waitForOutput(t, out, "run programme?")
+	cancel()
+	err := wait(t, done)
+	if !errors.Is(err, ErrCanceled) || !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the session to end with ErrCanceled, got %v", err)
+	}
+}
+
+func TestRunCanceledDuringExec(t *testing.T) {
+	t.Parallel()
+	sh, in, out := newTestShell(t)
+	defer in.Close()
+	var displayed bool
+	canceled := make(chan struct{})
+	sh.ThenRun(func(ctx context.Context, cf context.CancelFunc) error {
+		<-ctx.Done()
+		close(canceled)
+		return ctx.Err()
+	}, "running...", 10*1000).ThenDisplay(func() string {
+		displayed = true
+		return "done"
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- sh.Run(ctx)
+	}()
+	waitForOutput(t, out, "running...")
+	cancel()
+	if err := wait(t, done); !errors.Is(err, ErrCanceled) {
+		t.Errorf("expected the session to end with ErrCanceled, got %v", err)
+	}
+	select {
+	case <-canceled:
+	default:
+		t.Errorf("expected the function's context to be cancelled")
+	}
+	if displayed {
+		t.Errorf("expected the flow to stop once the context was cancelled")
+	}
+	if !strings.Contains(out.String(), "running...  ...cancelled") {
+		t.Errorf("expected the loading message to show that the function was cancelled")
+	}
+}
+
 func TestAsk(t *testing.T) {
-	Testing = true
-	sh := NewShell()
+	t.Parallel()
+	sh, in, _ := newTestShell(t)
+	defer in.Close()
 	var message string
 	sh.SetGreeting("welcome to the test shell").
 		FirstInstruction("run programme?").IfUserInputs("yes", "y", "Yes", "YES", "Y").
@@ -207,31 +1107,30 @@ func TestAsk(t *testing.T) {
 			message = fmt.Sprintf("you answered: %s", sh.GetValue("animal_mineral_vegetable"))
 			return nil
 		}, "running...", 100) // should quit when the propagation stops
-	go sh.Start()
-	bufferOutput()
+	done := start(sh)
 	// Spam with some empty answers
-	write(sh, string("\n"))
-	write(sh, string("\n"))
-	write(sh, string("\n"))
-	write(sh, string("\n"))
-	write(sh, string("\n"))
-	write(sh, string("\n"))
-	write(sh, string("robot\n"))
-	getOutput()
+	write(t, in, string("\n"))
+	write(t, in, string("\n"))
+	write(t, in, string("\n"))
+	write(t, in, string("\n"))
+	write(t, in, string("\n"))
+	write(t, in, string("\n"))
+	write(t, in, string("robot\n"))
+	wait(t, done)
 	if len(message) < 1 || message != "you answered: robot" {
 		t.Errorf("expected message from function to be 'you answered: robot', got '%s'", message)
 	}
 }
 
 func TestAskInt(t *testing.T) {
-	Testing = true
-	sh := NewShell()
+	t.Parallel()
+	sh, in, _ := newTestShell(t)
+	defer in.Close()
 	sh.SetGreeting("welcome to the test shell").SetBufferSize(100).AskForInt("how many apples do you want?", "apples")
-	go sh.Start()
-	bufferOutput()
-	write(sh, "I don't want any apples\n")
-	write(sh, "17\n")
-	getOutput()
+	done := start(sh)
+	write(t, in, "I don't want any apples\n")
+	write(t, in, "17\n")
+	wait(t, done)
 
 	apples, _ := sh.GetIntValue("apples")
 	if apples != 17 {
@@ -244,14 +1143,14 @@ func TestAskInt(t *testing.T) {
 }
 
 func TestAskFloat(t *testing.T) {
-	Testing = true
-	sh := NewShell()
+	t.Parallel()
+	sh, in, _ := newTestShell(t)
+	defer in.Close()
 	sh.SetGreeting("welcome to the test shell").SetBufferSize(100).AskForFloat("how tall are you (cm)?", "height")
-	go sh.Start()
-	bufferOutput()
-	write(sh, "I don't know\n")
-	write(sh, "180.2\n")
-	getOutput()
+	done := start(sh)
+	write(t, in, "I don't know\n")
+	write(t, in, "180.2\n")
+	wait(t, done)
 	height, _ := sh.GetFloatValue("height")
 	if height != 180.2 {
 		t.Errorf("expected user input to be 180.2, got %f", height)
@@ -262,33 +1161,571 @@ func TestAskFloat(t *testing.T) {
 	}
 }
 
+func TestHistory(t *testing.T) {
+	t.Parallel()
+	file := filepath.Join(t.TempDir(), "history")
+	for _, input := range []string{"deploy\n", string([]byte{27, 91, 65}) + "\n"} {
+		sh, in, out := newTestShell(t, WithHistoryFile(file))
+		sh.FirstInstruction("run programme?").
+			IfUserInputs("deploy").
+			Ask("token?", "token").Sensitive().
+			ThenQuit("deploying")
+		done := start(sh)
+		// the second session recalls the last input with the up arrow
+		write(t, in, input)
+		write(t, in, "secret\n")
+		if err := wait(t, done); err != nil {
+			t.Fatalf("expected the session to end without an error, got %v", err)
+		}
+		in.Close()
+		if !strings.Contains(out.String(), "deploying") {
+			t.Errorf("expected the session to reach ThenQuit, got '%s'", out.String())
+		}
+		if sh.GetValue("token") != "secret" {
+			t.Errorf("expected the sensitive answer to be stored, got '%s'", sh.GetValue("token"))
+		}
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the sensitive answer and the repeated command are left out
+	if expect := "deploy\n"; string(content) != expect {
+		t.Errorf("expected the history file to contain %q, got %q", expect, string(content))
+	}
+}
+
+func TestAskWithValidator(t *testing.T) {
+	t.Parallel()
+	sh, in, out := newTestShell(t)
+	defer in.Close()
+	sh.FirstInstruction("run programme?").IfUserInputs("yes").
+		AskWithValidator("username?", "username", func(answer string) error {
+			if answer == "admin" {
+				return fmt.Errorf("the username '%s' is taken", answer)
+			}
+			return nil
+		}).
+		AskForIntInRange("replicas?", "replicas", 1, 10).
+		AskMatching("version?", "version", `^v\d+\.\d+$`)
+	done := start(sh)
+	for _, input := range []string{"yes", "admin", "bob", "abc", "11", "7", "1.2", "v1.2"} {
+		write(t, in, input+"\n")
+	}
+	wait(t, done)
+	if username := sh.GetValue("username"); username != "bob" {
+		t.Errorf("expected username to be 'bob', got '%s'", username)
+	}
+	if replicas, found := sh.GetIntValue("replicas"); !found || replicas != 7 {
+		t.Errorf("expected replicas to be 7, got %d (found: %v)", replicas, found)
+	}
+	if version := sh.GetValue("version"); version != "v1.2" {
+		t.Errorf("expected version to be 'v1.2', got '%s'", version)
+	}
+	for _, message := range []string{"> the username 'admin' is taken", "> Please enter a value matching ^v\\d+\\.\\d+$"} {
+		if !strings.Contains(out.String(), message) {
+			t.Errorf("expected output to contain '%s'", message)
+		}
+	}
+	if count := strings.Count(out.String(), "Please enter an integer from 1 to 10"); count != 2 {
+		t.Errorf("expected to be prompted again twice for replicas, got %d", count)
+	}
+}
+
+func TestAskDefault(t *testing.T) {
+	t.Parallel()
+	sh, in, out := newTestShell(t)
+	defer in.Close()
+	sh.FirstInstruction("run programme?").IfUserInputs("yes").
+		AskWithDefault("host?", "host", "localhost").
+		AskForIntWithDefault("port?", "port", 8080).
+		AskForFloatWithDefault("ratio?", "ratio", 0.5)
+	done := start(sh)
+	write(t, in, "yes\n")
+	write(t, in, "\n")
+	write(t, in, "\n")
+	write(t, in, "0.75\n")
+	wait(t, done)
+	if host := sh.GetValue("host"); host != "localhost" {
+		t.Errorf("expected host to be 'localhost', got '%s'", host)
+	}
+	if port, found := sh.GetIntValue("port"); !found || port != 8080 {
+		t.Errorf("expected port to be 8080, got %d (found: %v)", port, found)
+	}
+	if ratio, found := sh.GetFloatValue("ratio"); !found || ratio != 0.75 {
+		t.Errorf("expected ratio to be 0.75, got %f (found: %v)", ratio, found)
+	}
+	for _, message := range []string{"> host? [localhost]", "> port? [8080]", "> ratio? [0.5]"} {
+		if !strings.Contains(out.String(), message) {
+			t.Errorf("expected output to contain '%s'", message)
+		}
+	}
+}
+
+func TestValidateQuestions(t *testing.T) {
+	t.Parallel()
+	sh, in, _ := newTestShell(t)
+	defer in.Close()
+	sh.AskMatching("version?", "version", `v(\d+`).
+		AskForIntInRange("replicas?", "replicas", 10, 1).
+		AskWithDefault("host?", "host", "")
+	err := sh.Validate()
+	for _, expect := range []string{"start: invalid pattern for 'version'", "start: invalid range for 'replicas': 10 is greater than 1", "start: the default answer for 'host' is empty"} {
+		if err == nil || !strings.Contains(err.Error(), expect) {
+			t.Errorf("expected '%s' to be reported, got %v", expect, err)
+		}
+	}
+}
+
+type semver struct {
+	major, minor int
+}
+
+func TestAnswers(t *testing.T) {
+	t.Parallel()
+	sh, in, out := newTestShell(t)
+	defer in.Close()
+	RegisterParser(sh, func(answer string) (semver, error) {
+		var version semver
+		if _, err := fmt.Sscanf(answer, "v%d.%d", &version.major, &version.minor); err != nil {
+			return version, errors.New("Please enter a version e.g. v1.2")
+		}
+		return version, nil
+	})
+	sh.FirstInstruction("run programme?").IfUserInputs("yes").
+		Ask("replicas?", "replicas").
+		Ask("timeout?", "timeout").
+		Ask("since?", "since")
+	AskFor[*url.URL](sh, "endpoint?", "endpoint")
+	AskFor[FilePath](sh, "config?", "config")
+	AskFor[semver](sh, "version?", "version")
+	done := start(sh)
+	for _, input := range []string{"yes", "3", "1m30s", "2024-03-01", "example.com", "https://example.com/api", "/etc/app/../app.yaml", "1.2", "v1.2"} {
+		write(t, in, input+"\n")
+	}
+	wait(t, done)
+	if replicas, found := Get[int](sh, "replicas"); !found || replicas != 3 {
+		t.Errorf("expected the answer 'replicas' to be read as 3, got %d (found: %v)", replicas, found)
+	}
+	if timeout, found := Get[time.Duration](sh, "timeout"); !found || timeout != time.Second*90 {
+		t.Errorf("expected the answer 'timeout' to be read as 1m30s, got %s (found: %v)", timeout, found)
+	}
+	if _, found := Get[int](sh, "timeout"); found {
+		t.Errorf("expected the answer 'timeout' not to be read as an int")
+	}
+	if since, found := Get[time.Time](sh, "since"); !found || since.Format("2006-01-02") != "2024-03-01" {
+		t.Errorf("expected the answer 'since' to be read as 2024-03-01, got %s (found: %v)", since, found)
+	}
+	if endpoint, found := Get[*url.URL](sh, "endpoint"); !found || endpoint.Host != "example.com" {
+		t.Errorf("expected the answer 'endpoint' to be a URL with the host example.com, got %v (found: %v)", endpoint, found)
+	}
+	if config, _ := Get[FilePath](sh, "config"); config != "/etc/app.yaml" {
+		t.Errorf("expected the answer 'config' to be '/etc/app.yaml', got '%s'", config)
+	}
+	if version, _ := Get[semver](sh, "version"); version != (semver{1, 2}) {
+		t.Errorf("expected the answer 'version' to be v1.2, got %v", version)
+	}
+	if answer, _ := sh.Answers().Get("version"); answer.Raw != "v1.2" || sh.GetValue("version") != "v1.2" {
+		t.Errorf("expected the answer 'version' to be kept as typed, got '%s'", answer.Raw)
+	}
+	if keys := strings.Join(sh.Answers().Keys(), ","); keys != "replicas,timeout,since,endpoint,config,version" {
+		t.Errorf("expected the keys in the order answered, got %s", keys)
+	}
+	if exported := sh.Answers().Export(); len(exported) != 6 || exported["replicas"] != "3" {
+		t.Errorf("expected all the answers to be exported, got %v", exported)
+	}
+	for _, message := range []string{"Please enter a URL e.g. https://example.com", "Please enter a version e.g. v1.2"} {
+		if !strings.Contains(out.String(), message) {
+			t.Errorf("expected output to contain '%s'", message)
+		}
+	}
+}
+
+func TestAskForUnregisteredType(t *testing.T) {
+	t.Parallel()
+	sh, in, _ := newTestShell(t)
+	defer in.Close()
+	AskFor[semver](sh, "version?", "version")
+	if err := sh.Validate(); err == nil || !strings.Contains(err.Error(), "no parser is registered for shellwrapper.semver") {
+		t.Errorf("expected the missing parser to be reported, got %v", err)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	t.Parallel()
+	sh, in, out := newTestShell(t)
+	defer in.Close()
+	sh.Ask("which environment?", "env").
+		AskForInt("how many replicas?", "replicas").
+		ThenBranch("deploy {{.replicas}} replicas to {{.env}}?", func() {
+			sh.IfUserInputs("yes").ThenQuit("deployed to {{.env}}").
+				IfUserInputs("no").ThenQuit("cancelled")
+		})
+	done := start(sh)
+	write(t, in, "staging\n")
+	write(t, in, "3\n")
+	write(t, in, "yes\n")
+	wait(t, done)
+	for _, message := range []string{"> deploy 3 replicas to staging? [options: yes, no]", "> deployed to staging"} {
+		if !strings.Contains(out.String(), message) {
+			t.Errorf("expected output to contain '%s', got '%s'", message, out.String())
+		}
+	}
+}
+
+func TestTemplateMissingAnswer(t *testing.T) {
+	t.Parallel()
+	sh, in, out := newTestShell(t)
+	defer in.Close()
+	sh.FirstInstruction("deploy to {{.env}}?").IfUserInputs("yes").ThenQuit("deployed")
+	err := wait(t, start(sh))
+	if !errors.Is(err, ErrMisconfigured) {
+		t.Errorf("expected the session to end with ErrMisconfigured, got %v", err)
+	}
+	if message := `could not display 'deploy to {{.env}}?'`; !strings.Contains(out.String(), message) || !strings.Contains(out.String(), `"env"`) {
+		t.Errorf("expected output to explain that 'env' is missing, got '%s'", out.String())
+	}
+}
+
+func TestInvalidTemplate(t *testing.T) {
+	t.Parallel()
+	sh, in, _ := newTestShell(t)
+	defer in.Close()
+	sh.FirstInstruction("deploy to {{.env?").IfUserInputs("yes").ThenQuit("deployed")
+	if err := sh.Validate(); err == nil || !strings.Contains(err.Error(), "start: invalid template 'deploy to {{.env?'") {
+		t.Errorf("expected the invalid template to be reported, got %v", err)
+	}
+}
+
+func TestThenIf(t *testing.T) {
+	t.Parallel()
+	for env, expect := range map[string]string{"production": "> deploying to production, take care", "staging": "> deploying to staging"} {
+		sh, in, out := newTestShell(t)
+		production := func(sh *Shell) bool {
+			return sh.GetValue("env") == "production"
+		}
+		sh.Ask("which environment?", "env").
+			ThenIf(production, func() {
+				sh.AskForBool("are you sure?", "sure").
+					ThenDisplay(func() string { return "deploying to production, take care" })
+			}, func() {
+				sh.ThenDisplay(func() string { return "deploying to staging" })
+			}).
+			ThenQuit("deployed to {{.env}}")
+		done := start(sh)
+		write(t, in, env+"\n")
+		if env == "production" {
+			write(t, in, "yes\n")
+		}
+		if err := wait(t, done); err != nil {
+			t.Errorf("expected the session to end without an error, got %v", err)
+		}
+		in.Close()
+		for _, message := range []string{expect, "> deployed to " + env} {
+			if !strings.Contains(out.String(), message) {
+				t.Errorf("expected output to contain '%s', got '%s'", message, out.String())
+			}
+		}
+	}
+}
+
+func TestSwitch(t *testing.T) {
+	t.Parallel()
+	sh, in, out := newTestShell(t)
+	defer in.Close()
+	sh.AskChoice("which environment?", "env", func() []string { return []string{"staging", "production"} }).
+		Switch("env", map[string]FlowFunc{
+			"staging": func() {
+				sh.FirstInstruction("which region?").
+					IfUserInputs("eu").ThenDisplay(func() string { return "region eu" }).
+					IfUserInputs("us").ThenDisplay(func() string { return "region us" })
+			},
+			"production": func() {
+				sh.ThenDisplay(func() string { return "all regions" })
+			},
+		}, nil).
+		AskForBool("dry run?", "dry").
+		Switch("dry", map[string]FlowFunc{
+			"true": func() {
+				sh.ThenQuit("dry run of {{.env}}")
+			},
+		}, func() {
+			sh.ThenDisplay(func() string { return "not a dry run" })
+		}).
+		ThenQuit("deployed to {{.env}}")
+	done := start(sh)
+	write(t, in, "1\n")
+	write(t, in, "us\n")
+	write(t, in, "y\n")
+	if err := wait(t, done); err != nil {
+		t.Errorf("expected the session to end without an error, got %v", err)
+	}
+	for _, message := range []string{"> which region? [options: eu, us]", "> region us", "> dry run of staging"} {
+		if !strings.Contains(out.String(), message) {
+			t.Errorf("expected output to contain '%s', got '%s'", message, out.String())
+		}
+	}
+	for _, message := range []string{"all regions", "not a dry run", "deployed to"} {
+		if strings.Contains(out.String(), message) {
+			t.Errorf("expected output not to contain '%s'", message)
+		}
+	}
+}
+
+func TestValidateConditions(t *testing.T) {
+	t.Parallel()
+	sh, in, _ := newTestShell(t)
+	defer in.Close()
+	sh.ThenIf(nil, nil, nil).
+		ThenIf(func(*Shell) bool { return true }, func() {}, func() {
+			sh.IfUserInputs("yes")
+		}).
+		Switch("env", map[string]FlowFunc{"staging": func() { sh.GoTo("missing", "") }}, nil).
+		Ask("name?", "name").OnError(func() {}).
+		ThenRun(func(ctx context.Context, cf context.CancelFunc) error { return nil }, "running...", 0).
+		OnError(func() { sh.IfUserInputs("retry") }).
+		FailFast().
+		Retry(RetryPolicy{MaxAttempts: 0, Delay: -time.Second, Jitter: 2}).
+		ThenRunParallel(nil, 0, -1).
+		Retry(RetryPolicy{MaxAttempts: 2}).
+		HideOutput().
+		Timeout(100).
+		ThenExec("true").
+		Timeout(0)
+	err := sh.Validate()
+	for _, expect := range []string{"start: Retry must make at least 1 attempt, got 0", "start: Retry cannot wait for a negative delay", "start: the jitter of Retry must be from 0 to 1, got 2", "start: Retry cannot follow ThenRunParallel", "start: HideOutput must directly follow ThenExec", "start: Timeout must directly follow ThenExec", "start: the timeout of ThenExec must be at least 1ms", "start: FailFast must directly follow ThenRunParallel", "start: ThenRunParallel has no tasks", "start: ThenRunParallel cannot run -1 tasks at once", "start: ThenIf has no condition", "start: ThenIf sets up nothing", "start > otherwise: command 'yes' is a dead end", "start > case 'staging': branch 'missing' not found", "start: OnError must directly follow ThenRun", "start > on error: command 'retry' is a dead end"} {
+		if err == nil || !strings.Contains(err.Error(), expect) {
+			t.Errorf("expected '%s' to be reported, got %v", expect, err)
+		}
+	}
+}
+
+func TestAskBool(t *testing.T) {
+	t.Parallel()
+	sh, in, out := newTestShell(t)
+	defer in.Close()
+	sh.FirstInstruction("run programme?").IfUserInputs("yes").
+		AskForBool("overwrite existing files?", "overwrite").
+		AskForBool("keep backups?", "backups")
+	done := start(sh)
+	write(t, in, "yes\n")
+	write(t, in, "maybe\n")
+	write(t, in, "YES\n")
+	write(t, in, "n\n")
+	wait(t, done)
+	if overwrite, found := sh.GetBoolValue("overwrite"); !found || !overwrite {
+		t.Errorf("expected overwrite to be true, got %v (found: %v)", overwrite, found)
+	}
+	if backups, found := sh.GetBoolValue("backups"); !found || backups {
+		t.Errorf("expected backups to be false, got %v (found: %v)", backups, found)
+	}
+	for _, message := range []string{"overwrite existing files? (yes/no)", "Please enter yes or no"} {
+		if !strings.Contains(out.String(), message) {
+			t.Errorf("expected output to contain '%s'", message)
+		}
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	t.Parallel()
+	sh, in, out := newTestShell(t, WithBoolAnswers([]string{"ja"}, []string{"nein"}))
+	defer in.Close()
+	sh.FirstInstruction("what now?").
+		IfUserInputs("deploy").Confirm("are you sure?").ThenQuit("deployed").
+		IfUserInputs("stop").Confirm("are you sure?").ThenQuit("stopped")
+	done := start(sh)
+	write(t, in, "deploy\n")
+	write(t, in, "NEIN\n")
+	write(t, in, "stop\n")
+	write(t, in, "Ja\n")
+	if err := wait(t, done); err != nil {
+		t.Errorf("expected the session to end without an error, got %v", err)
+	}
+	if strings.Contains(out.String(), "deployed") || !strings.Contains(out.String(), "stopped") {
+		t.Errorf("expected only the confirmed command to run, got '%s'", out.String())
+	}
+	if count := countShellBuffer(sh, "what now?"); count != 2 {
+		t.Errorf("expected to be taken back to the first prompt once, got the prompt %d times", count)
+	}
+}
+
+func TestConfirmDeclined(t *testing.T) {
+	t.Parallel()
+	sh, in, out := newTestShell(t)
+	defer in.Close()
+	sh.Confirm("deploy to production?").ThenQuit("deployed")
+	done := start(sh)
+	write(t, in, "no\n")
+	if err := wait(t, done); !errors.Is(err, ErrDeclined) {
+		t.Errorf("expected the session to end with ErrDeclined, got %v", err)
+	}
+	if strings.Contains(out.String(), "deployed") {
+		t.Errorf("expected the flow not to continue once the user declined")
+	}
+}
+
+func TestAskChoice(t *testing.T) {
+	t.Parallel()
+	sh, in, out := newTestShell(t)
+	defer in.Close()
+	environments := func() []string {
+		return []string{"staging", "production", "dev"}
+	}
+	sh.FirstInstruction("run programme?").IfUserInputs("yes").
+		AskChoice("which environment?", "environment", environments).
+		AskChoice("which region?", "region", func() []string { return []string{"eu", "us"} })
+	done := start(sh)
+	write(t, in, "yes\n")
+	write(t, in, "4\n")
+	write(t, in, "prod\n")
+	write(t, in, "PRODUCTION\n")
+	write(t, in, "2\n")
+	wait(t, done)
+	if environment := sh.GetValue("environment"); environment != "production" {
+		t.Errorf("expected environment to be 'production', got '%s'", environment)
+	}
+	if region := sh.GetValue("region"); region != "us" {
+		t.Errorf("expected region to be 'us', got '%s'", region)
+	}
+	for _, message := range []string{"> which environment?\n  1) staging\n  2) production\n  3) dev\n", "Please enter a number from 1 to 3, or one of the options"} {
+		if !strings.Contains(out.String(), message) {
+			t.Errorf("expected output to contain '%s'", message)
+		}
+	}
+	if count := strings.Count(out.String(), "Please enter a number from 1 to 3"); count != 2 {
+		t.Errorf("expected to be prompted again twice, got %d", count)
+	}
+}
+
+func TestAskChoiceNumericOptions(t *testing.T) {
+	t.Parallel()
+	sh, in, _ := newTestShell(t)
+	defer in.Close()
+	sh.FirstInstruction("run programme?").IfUserInputs("yes").
+		AskChoice("how many replicas?", "replicas", func() []string { return []string{"10", "20"} }).
+		AskChoice("which version?", "version", func() []string { return []string{"1", "3", "2"} }).
+		AskChoice("which port?", "port", func() []string { return []string{"80", "80", "443"} })
+	done := start(sh)
+	write(t, in, "yes\n")
+	write(t, in, "10\n")
+	write(t, in, "2\n")
+	write(t, in, "2\n")
+	wait(t, done)
+	for storeAs, expect := range map[string]string{"replicas": "10", "version": "2", "port": "80"} {
+		if value := sh.GetValue(storeAs); value != expect {
+			t.Errorf("expected %s to be '%s', got '%s'", storeAs, expect, value)
+		}
+	}
+}
+
+func TestAskMultiChoice(t *testing.T) {
+	t.Parallel()
+	sh, in, out := newTestShell(t)
+	defer in.Close()
+	services := func() []string {
+		return []string{"api", "web", "worker", "cron", "db"}
+	}
+	sh.FirstInstruction("run programme?").IfUserInputs("yes").
+		AskMultiChoice("which services?", "services", services)
+	done := start(sh)
+	write(t, in, "yes\n")
+	write(t, in, "2-6\n")
+	write(t, in, "1, queue\n")
+	write(t, in, " , \n")
+	write(t, in, "DB, 2-3,1,web\n")
+	wait(t, done)
+	chosen, found := sh.GetValues("services")
+	if expect := []string{"api", "web", "worker", "db"}; !found || strings.Join(chosen, ",") != strings.Join(expect, ",") {
+		t.Errorf("expected the services chosen to be %v, got %v (found: %v)", expect, chosen, found)
+	}
+	for _, message := range []string{"'2-6' is not a range of options", "'queue' is not one of the options", "no options were chosen; please enter numbers from 1 to 5, ranges such as 1-5 or options, separated by commas"} {
+		if !strings.Contains(out.String(), message) {
+			t.Errorf("expected output to contain '%s'", message)
+		}
+	}
+}
+
+func TestAskChoiceWithoutOptions(t *testing.T) {
+	t.Parallel()
+	sh, in, _ := newTestShell(t)
+	defer in.Close()
+	sh.AskChoice("which environment?", "environment", func() []string { return nil })
+	if err := wait(t, start(sh)); !errors.Is(err, ErrMisconfigured) {
+		t.Errorf("expected the session to end with ErrMisconfigured, got %v", err)
+	}
+}
+
+func TestAskSecret(t *testing.T) {
+	t.Parallel()
+	sh, in, out := newTestShell(t)
+	defer in.Close()
+	var secret string
+	sh.FirstInstruction("log in?").IfUserInputs("yes").
+		AskSecret("password?", "password").
+		ThenRun(func(ctx context.Context, cf context.CancelFunc) error {
+			password, _ := sh.GetSecret("password")
+			secret = string(password)
+			return nil
+		}, "logging in...", 100)
+	done := start(sh)
+	write(t, in, "yes\n")
+	write(t, in, "\n")
+	write(t, in, " p4ss word\t\n")
+	wait(t, done)
+	if secret != " p4ss word\t" {
+		t.Errorf("expected the secret to be ' p4ss word\\t', got '%s'", secret)
+	}
+	if sh.GetValue("password") != "" {
+		t.Errorf("expected the secret not to be available from GetValue")
+	}
+	for e := sh.Buffer.Front(); e != nil; e = e.Next() {
+		if b := e.Value.(*BufferObject); strings.Contains(b.In, "p4ss") || strings.Contains(b.Out, "p4ss") {
+			t.Errorf("expected the secret not to be in the buffer, got %+v", b)
+		}
+	}
+	if captured := <-sh.LastCaptured; captured != "yes" {
+		t.Errorf("expected the last captured input to be 'yes', got '%s'", captured)
+	}
+	if sh.history.last() != "yes" || strings.Contains(out.String(), "p4ss") {
+		t.Errorf("expected the secret not to be in the history or the output")
+	}
+	password, _ := sh.GetSecret("password")
+	sh.ZeroSecret("password")
+	if !bytes.Equal(password, make([]byte, len(password))) {
+		t.Errorf("expected ZeroSecret to zero the secret, got %q", password)
+	}
+	if _, found := sh.GetSecret("password"); found {
+		t.Errorf("expected ZeroSecret to forget the secret")
+	}
+}
+
 func TestThenDisplay(t *testing.T) {
-	Testing = true
-	sh := NewShell()
+	t.Parallel()
+	sh, in, _ := newTestShell(t)
+	defer in.Close()
 	sh.SetGreeting("welcome to the test shell").SetBufferSize(100).ThenDisplay(func() string {
 		return "> guess this programme was pretty pointless huh?"
 	})
-	go sh.Start()
-	bufferOutput()
-	time.Sleep(time.Second * 1)
-	getOutput()
+	done := start(sh)
+	if err := wait(t, done); err != nil {
+		t.Errorf("expected the session to end without an error, got %v", err)
+	}
 	if err := checkShellBuffer(sh, []string{"guess this programme was pretty pointless huh?"}, false); err != nil {
 		t.Error(err)
 	}
 }
 
 func TestSmallBuffer(t *testing.T) {
-	Testing = true
-	sh := NewShell()
+	t.Parallel()
+	sh, in, _ := newTestShell(t)
+	defer in.Close()
 	sh.SetGreeting("welcome to the test shell").SetBufferSize(1).ThenDisplay(func() string {
 		return "> This should be the only buffer item, and it will soon be replaced..."
 	}).ThenDisplay(func() string {
 		return "> guess this programme was pretty pointless huh?"
 	})
-	go sh.Start()
-	bufferOutput()
-	time.Sleep(time.Second * 1)
-	getOutput()
+	done := start(sh)
+	wait(t, done)
 	e := sh.Buffer.Front()
 	if e == nil {
 		t.Fatalf("expected one buffer item, got none")
@@ -299,33 +1736,71 @@ func TestSmallBuffer(t *testing.T) {
 }
 
 func TestInterrupt(t *testing.T) {
-	Testing = true
-	sh := NewShell()
+	t.Parallel()
+	sh, in, out := newTestShell(t)
+	defer in.Close()
 	sh.SetGreeting("welcome to the test shell").
 		FirstInstruction("run programme?").IfUserInputs("yes", "y", "Yes", "YES", "Y").
 		Default("yes").ThenQuit("done with programme")
-	go sh.Start()
-	bufferOutput()
-	time.Sleep(time.Second * 2) // should have timed out after three seconds
+	done := start(sh)
+	waitForOutput(t, out, "run programme?")
 	sh.OsInterrupt <- os.Interrupt
-	getOutput()
+	if err := wait(t, done); !errors.Is(err, ErrInterrupted) {
+		t.Errorf("expected the session to end with ErrInterrupted, got %v", err)
+	}
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func newTestShell(t *testing.T, opts ...Option) (*Shell, *io.PipeWriter, *syncBuffer) {
+	t.Helper()
+	r, w := io.Pipe()
+	out := &syncBuffer{}
+	sh, err := NewShellWithIO(r, out, out, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sh, w, out
 }
 
-func bufferOutput() {
-	r, w, _ = os.Pipe()
-	os.Stdout = w
-	outC = make(chan string)
+func start(sh *Shell) <-chan error {
+	done := make(chan error, 1)
 	go func() {
-		var buf bytes.Buffer
-		io.Copy(&buf, r)
-		outC <- buf.String()
+		done <- sh.Start()
 	}()
+	return done
 }
 
-func getOutput() string {
-	w.Close()
-	os.Stdout = old
-	return <-outC
+func wait(t *testing.T, done <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(time.Second * 10):
+		t.Fatal("timed out waiting for the shell to exit")
+	}
+	return nil
+}
+
+func waitForOutput(t *testing.T, out *syncBuffer, message string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for !strings.Contains(out.String(), message) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for output '%s'", message)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
 }
 
 func checkShellBuffer(sh *Shell, messages []string, notIn bool) error {
@@ -355,8 +1830,63 @@ func checkShellBuffer(sh *Shell, messages []string, notIn bool) error {
 	return nil
 }
 
-func write(sh *Shell, input string) {
-	sh.StdIn.(*bytes.Buffer).WriteString(input)
-	sh.waitForInput()
-	time.Sleep(time.Second * 1)
+// waitForNoShellGoroutines fails the test if goroutines running the
+// package's code are left once those that are exiting have had time to
+func waitForNoShellGoroutines(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		stacks := shellGoroutines()
+		if len(stacks) < 1 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected no goroutines to survive Start returning, got:\n%s", strings.Join(stacks, "\n\n"))
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// shellGoroutines returns the stacks of the goroutines that are running
+// the package's code (rather than its tests) or uilive's
+func shellGoroutines() []string {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	stacks := make([]string, 0)
+	for _, stack := range strings.Split(string(buf), "\n\n") {
+		lines := strings.Split(stack, "\n")
+		for i := 1; i+1 < len(lines); i++ {
+			frame, file := lines[i], lines[i+1]
+			if (strings.Contains(frame, "shellwrapper.") && !strings.Contains(file, "_test.go")) || strings.Contains(frame, "uilive.") {
+				stacks = append(stacks, stack)
+				break
+			}
+		}
+	}
+	return stacks
+}
+
+func countShellBuffer(sh *Shell, message string) int {
+	var count int
+	for e := sh.Buffer.Front(); e != nil; e = e.Next() {
+		if bufferObject, ok := e.Value.(*BufferObject); ok && strings.Contains(bufferObject.Out, message) {
+			count++
+		}
+	}
+	return count
+}
+
+// write blocks until the shell has read the input
+func write(t *testing.T, in io.Writer, input string) {
+	t.Helper()
+	written := make(chan struct{})
+	go func() {
+		fmt.Fprint(in, input)
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("timed out writing '%s'", strings.TrimSpace(input))
+	}
 }
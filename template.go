@@ -0,0 +1,46 @@
+package shellwrapper
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// checkTemplate parses text as a template when the flow is set up, so
+// that mistakes are reported by Validate
+func (s *Shell) checkTemplate(text string) {
+	if _, err := s.template(text); err != nil {
+		flow := s.getFlow()
+		flow.problems = append(flow.problems, err)
+	}
+}
+
+func (s *Shell) template(text string) (*template.Template, error) {
+	if tmpl, ok := s.templates[text]; ok {
+		return tmpl, nil
+	}
+	tmpl, err := template.New("message").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template '%s': %w", text, err)
+	}
+	s.templates[text] = tmpl
+	return tmpl, nil
+}
+
+// render renders text, which may refer to the answers collected so far
+// as {{.storeAs}}; the session ends if an answer it refers to is missing
+func (s *Shell) render(text string) (string, bool) {
+	if !strings.Contains(text, "{{") {
+		return text, true
+	}
+	tmpl, err := s.template(text)
+	if err == nil {
+		var rendered strings.Builder
+		if err = tmpl.Execute(&rendered, s.answers.Export()); err == nil {
+			return rendered.String(), true
+		}
+		err = fmt.Errorf("could not display '%s': %w", text, err)
+	}
+	s.fail(ErrMisconfigured, err)
+	return "", false
+}
@@ -0,0 +1,39 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package shellwrapper
+
+import "io"
+
+// terminal is not supported on this platform, so the shell always
+// reads its input a line at a time
+type terminal struct{}
+
+func openTerminal(in io.Reader) (*terminal, bool) {
+	return nil, false
+}
+
+func isTerminal(out io.Writer) bool {
+	return false
+}
+
+func (t *terminal) edit() error {
+	return nil
+}
+
+func (t *terminal) hide() error {
+	return nil
+}
+
+func (t *terminal) restore() error {
+	return nil
+}
+
+func (t *terminal) reader(done, abandon <-chan struct{}) io.Reader {
+	return nil
+}
+
+// fileReader is not supported on this platform, so reads of files are
+// cancelled like those of other readers
+func fileReader(in io.Reader, done, abandon <-chan struct{}) (io.Reader, bool) {
+	return nil, false
+}
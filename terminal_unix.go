@@ -0,0 +1,147 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package shellwrapper
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+type (
+	// terminal switches a TTY between its original mode and the mode
+	// used by the line editor
+	terminal struct {
+		fd       int
+		original unix.Termios
+	}
+
+	// pollReader reads from a file such as a TTY or a pipe; a pending
+	// read returns errEnded once done is closed, and errAbandoned if a
+	// value is received from abandon
+	pollReader struct {
+		fd      int
+		done    <-chan struct{}
+		abandon <-chan struct{}
+	}
+)
+
+// pollInterval is how often (in milliseconds) a pending read of a
+// file checks whether the shell has ended
+const pollInterval = 100
+
+// openTerminal returns a terminal if in is a TTY
+func openTerminal(in io.Reader) (*terminal, bool) {
+	fd, ok := descriptor(in)
+	if !ok {
+		return nil, false
+	}
+	original, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return nil, false
+	}
+	return &terminal{fd: fd, original: *original}, true
+}
+
+// isTerminal reports whether out is a TTY
+func isTerminal(out io.Writer) bool {
+	fd, ok := descriptor(out)
+	if !ok {
+		return false
+	}
+	_, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	return err == nil
+}
+
+// descriptor returns the file descriptor of f if it is a file
+func descriptor(f any) (int, bool) {
+	file, ok := f.(*os.File)
+	if !ok {
+		return 0, false
+	}
+	// file.Fd would put the file into blocking mode, which stops read
+	// deadlines from interrupting reads on inputs that are not TTYs
+	conn, err := file.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+	var fd int
+	if err := conn.Control(func(descriptor uintptr) { fd = int(descriptor) }); err != nil {
+		return 0, false
+	}
+	return fd, true
+}
+
+// edit turns off line buffering, echo and signal keys, so that the
+// line editor receives every key as it is typed
+func (t *terminal) edit() error {
+	termios := t.original
+	termios.Lflag &^= unix.ICANON | unix.ECHO | unix.ISIG
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+	return unix.IoctlSetTermios(t.fd, ioctlSetTermios, &termios)
+}
+
+// hide turns off echo, leaving the TTY to read a line at a time, so
+// that hidden input can be read without the line editor
+func (t *terminal) hide() error {
+	termios := t.original
+	termios.Lflag &^= unix.ECHO
+	return unix.IoctlSetTermios(t.fd, ioctlSetTermios, &termios)
+}
+
+func (t *terminal) restore() error {
+	return unix.IoctlSetTermios(t.fd, ioctlSetTermios, &t.original)
+}
+
+func (t *terminal) reader(done, abandon <-chan struct{}) io.Reader {
+	return &pollReader{fd: t.fd, done: done, abandon: abandon}
+}
+
+// fileReader returns a reader of in whose pending reads return once done
+// is closed or a value is received from abandon, if in is a file
+func fileReader(in io.Reader, done, abandon <-chan struct{}) (io.Reader, bool) {
+	fd, ok := descriptor(in)
+	if !ok {
+		return nil, false
+	}
+	return &pollReader{fd: fd, done: done, abandon: abandon}, true
+}
+
+func (r *pollReader) Read(p []byte) (int, error) {
+	fds := []unix.PollFd{{Fd: int32(r.fd), Events: unix.POLLIN}}
+	for {
+		select {
+		case <-r.done:
+			return 0, errEnded
+		case <-r.abandon:
+			return 0, errAbandoned
+		default:
+		}
+		n, err := unix.Poll(fds, pollInterval)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if n < 1 {
+			continue
+		}
+		if fds[0].Revents&unix.POLLIN == 0 && fds[0].Revents&(unix.POLLHUP|unix.POLLERR) != 0 {
+			return 0, io.EOF
+		}
+		n, err = unix.Read(r.fd, p)
+		if err == unix.EINTR || err == unix.EAGAIN {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, io.EOF
+		}
+		return n, nil
+	}
+}
@@ -0,0 +1,165 @@
+package shellwrapper
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+type (
+	// ValidationError lists every problem that Validate found in the flow
+	ValidationError struct {
+		Problems []error
+	}
+
+	validator struct {
+		shell      *Shell
+		problems   []error
+		referenced map[string]bool
+		building   map[uintptr]bool
+	}
+)
+
+func (v *ValidationError) Error() string {
+	problems := make([]string, 0, len(v.Problems))
+	for _, problem := range v.Problems {
+		problems = append(problems, problem.Error())
+	}
+	return "invalid flow: " + strings.Join(problems, "; ")
+}
+
+// Unwrap lets errors.Is and errors.As match any of the problems
+func (v *ValidationError) Unwrap() []error {
+	return v.Problems
+}
+
+// Validate walks the flow, including the branches that are only built once
+// the shell is running, and reports GoTos to unknown branches, duplicate
+// commands, defaults that match no command, commands that lead to flows
+// without events and branches that are never visited. All problems are
+// aggregated in a *ValidationError. Validate is also run by Start.
+// To walk the branches Validate runs the FlowFuncs passed to ThenBranch,
+// Branch, ThenIf, Switch, OnError and OnSuccess, which run again when the
+// flow reaches them, so they should only set up rules
+func (s *Shell) Validate() error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *Shell) validate() *ValidationError {
+	v := &validator{
+		shell:      s,
+		problems:   make([]error, 0),
+		referenced: make(map[string]bool),
+		building:   make(map[uintptr]bool),
+	}
+	v.flow("start", s.root)
+	names := make([]string, 0, len(s.branches))
+	for name := range s.branches {
+		if !v.referenced[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v.problems = append(v.problems, fmt.Errorf("branch '%s' is never visited", name))
+	}
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+	return nil
+}
+
+func (v *validator) flow(path string, flow *Flow) {
+	for _, problem := range flow.problems {
+		v.problem(path, problem.Error())
+	}
+	if len(flow.Default) > 0 {
+		if _, ok := flow.Flows[flow.Default]; !ok {
+			v.problem(path, fmt.Sprintf("default '%s' matches no command", flow.Default))
+		}
+	}
+	for _, link := range flow.links {
+		v.link(path, link)
+	}
+	for _, command := range flow.BaseCommands {
+		next := flow.Flows[command]
+		if next.Events.Len() < 1 {
+			v.problem(path, fmt.Sprintf("command '%s' is a dead end (nothing happens after it)", command))
+			continue
+		}
+		v.flow(path+" > "+command, next)
+	}
+}
+
+func (v *validator) link(path string, link flowLink) {
+	if len(link.branch) < 1 {
+		// rules set up with ThenBranch are built into the flow they belong to
+		if !v.enter(link.build) {
+			return
+		}
+		defer v.leave(link.build)
+		flow := v.shell.buildFlow(link.build)
+		if flow.Events.Len() < 1 {
+			v.problem(path, link.step+" sets up nothing")
+			return
+		}
+		if len(link.label) > 0 {
+			path += " > " + link.label
+		}
+		v.flow(path, flow)
+		return
+	}
+	branch, ok := v.shell.branches[link.branch]
+	if !ok {
+		v.problem(path, fmt.Sprintf("branch '%s' not found", link.branch))
+		return
+	}
+	if v.referenced[link.branch] {
+		return
+	}
+	v.referenced[link.branch] = true
+	flow := v.shell.buildFlow(branch)
+	if flow.Events.Len() < 1 {
+		v.problem(fmt.Sprintf("branch '%s'", link.branch), "the branch sets up nothing")
+		return
+	}
+	v.flow(fmt.Sprintf("branch '%s'", link.branch), flow)
+}
+
+// enter reports whether the rules f are not already being walked; rules
+// that set themselves up again, even through a new closure of the same
+// function literal, are walked once, so that they are not walked forever
+func (v *validator) enter(f FlowFunc) bool {
+	pointer := reflect.ValueOf(f).Pointer()
+	if v.building[pointer] {
+		return false
+	}
+	v.building[pointer] = true
+	return true
+}
+
+// leave marks the rules f as walked, so that other rules set up by the
+// same function literal are walked in their own right
+func (v *validator) leave(f FlowFunc) {
+	delete(v.building, reflect.ValueOf(f).Pointer())
+}
+
+func (v *validator) problem(path, problem string) {
+	v.problems = append(v.problems, fmt.Errorf("%s: %s", path, problem))
+}
+
+// buildFlow sets up the rules f on a new flow, leaving the shell's
+// current flow untouched
+func (s *Shell) buildFlow(f FlowFunc) *Flow {
+	flow, command := s.flow, s.command
+	defer func() {
+		s.flow, s.command = flow, command
+	}()
+	s.flow, s.command = s.newFlow(), ""
+	f()
+	return s.flow
+}